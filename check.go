@@ -0,0 +1,78 @@
+package protosync
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/resolver"
+	"github.com/cashapp/protosync/sink"
+)
+
+// DifferenceKind describes how a file in the destination differs from the resolved closure.
+type DifferenceKind string
+
+// Kinds of difference.
+const (
+	// Missing files are in the resolved closure but not in the destination.
+	Missing DifferenceKind = "missing"
+	// Changed files are in both, but their content differs.
+	Changed DifferenceKind = "changed"
+	// Extraneous files are in the destination but not in the resolved closure.
+	Extraneous DifferenceKind = "extraneous"
+)
+
+// A Difference between the resolved closure and the destination.
+type Difference struct {
+	Kind DifferenceKind
+	// Import path of the file, relative to the destination.
+	Import string
+}
+
+func (d Difference) String() string { return string(d.Kind) + ": " + d.Import }
+
+// Check resolves imports exactly like Sync, but compares the result against dest rather than writing to it.
+//
+// Returns the differences ordered by import path, which will be empty if dest is up to date.
+func Check(ctx context.Context, resolve resolver.Resolver, dest sink.Sink, sources []string, options ...Option) ([]Difference, error) {
+	diffs := []Difference{}
+	s := newSyncer(ctx, resolve, dest, sources, options)
+	s.write = func(s *syncer, result SyncResult, data []byte) (FileAction, error) {
+		existing, err := fs.ReadFile(dest, result.Import)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			diffs = append(diffs, Difference{Kind: Missing, Import: result.Import})
+			return FileCreated, nil
+		case err != nil:
+			return "", errors.WithStack(err)
+		case !bytes.Equal(existing, data):
+			diffs = append(diffs, Difference{Kind: Changed, Import: result.Import})
+			return FileOverwritten, nil
+		}
+		return FileUnchanged, nil
+	}
+	if err := s.run(); err != nil {
+		return nil, err
+	}
+	err := fs.WalkDir(dest, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".proto") {
+			return nil
+		}
+		if !s.resolved[path] {
+			diffs = append(diffs, Difference{Kind: Extraneous, Import: path})
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Import < diffs[j].Import })
+	return diffs, nil
+}
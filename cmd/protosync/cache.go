@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/log"
+	"github.com/cashapp/protosync/resolver"
+)
+
+type cacheCmd struct {
+	List   cacheListCmd   `cmd:"" help:"List cached clones, files and JARs."`
+	Size   cacheSizeCmd   `cmd:"" help:"Print the total size of the cache."`
+	Clean  cacheCleanCmd  `cmd:"" help:"Remove entries from the cache, by default all of them."`
+	Protos cacheProtosCmd `cmd:"" help:"List the .proto files provided by cached JARs."`
+}
+
+type cacheListCmd struct{}
+
+func (c *cacheListCmd) Run() error {
+	entries, err := resolver.ListCache()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tSIZE\tMODIFIED\tSOURCE\tPATH")
+	for _, entry := range entries {
+		source := entry.Source
+		if entry.Version != "" {
+			source += "@" + entry.Version
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", entry.Kind, resolver.FormatSize(entry.Size),
+			entry.Modified.Format("2006-01-02 15:04"), source, entry.Path)
+	}
+	return errors.WithStack(w.Flush())
+}
+
+type cacheSizeCmd struct{}
+
+func (c *cacheSizeCmd) Run() error {
+	entries, err := resolver.ListCache()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	dir, err := resolver.CacheDir()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%s (%d entries)\n", resolver.FormatSize(total), dir, len(entries))
+	return nil
+}
+
+type cacheCleanCmd struct {
+	OlderThan string `placeholder:"AGE" help:"Only remove entries not modified or used within AGE, eg. 30d or 12h."`
+	Repo      string `placeholder:"SOURCE" help:"Only remove entries whose repository URL or JAR name contains SOURCE."`
+}
+
+func (c *cacheCleanCmd) Run(ctx context.Context) error {
+	var cutoff time.Time
+	if c.OlderThan != "" {
+		age, err := parseAge(c.OlderThan)
+		if err != nil {
+			return err
+		}
+		cutoff = time.Now().Add(-age)
+	}
+	entries, err := resolver.ListCache()
+	if err != nil {
+		return err
+	}
+	removed := 0
+	var size int64
+	for _, entry := range entries {
+		if !cutoff.IsZero() && entry.Modified.After(cutoff) {
+			continue
+		}
+		if c.Repo != "" && !strings.Contains(entry.Source, c.Repo) {
+			continue
+		}
+		log.Debugf("Removing %s", entry.Path)
+		if err := entry.Remove(ctx); err != nil {
+			return err
+		}
+		removed++
+		size += entry.Size
+	}
+	log.Infof("Removed %d cache entries, freeing %s", removed, resolver.FormatSize(size))
+	return nil
+}
+
+type cacheProtosCmd struct {
+	JAR string `arg:"" optional:"" help:"Only list protos in JARs whose name contains JAR."`
+}
+
+func (c *cacheProtosCmd) Run() error {
+	entries, err := resolver.ListCache()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Kind != resolver.CachedJAR || !strings.Contains(entry.Source, c.JAR) {
+			continue
+		}
+		protos, err := entry.Protos()
+		if err != nil {
+			return err
+		}
+		for _, proto := range protos {
+			fmt.Printf("%s\t%s\n", entry.Source, proto)
+		}
+	}
+	return nil
+}
+
+// Parse a duration, additionally accepting a number of days such as "30d".
+func parseAge(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, errors.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid age %q", s)
+	}
+	return age, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync"
+	"github.com/cashapp/protosync/sink"
+)
+
+type checkCmd struct {
+	Sources []string `arg:"" optional:"" help:"Additional proto files to check."`
+}
+
+func (c *checkCmd) Run(ctx context.Context) error {
+	p, err := loadProject(c.Sources, false)
+	if err != nil {
+		return err
+	}
+	if err := p.requireDest(); err != nil {
+		return err
+	}
+	diffs, err := protosync.Check(ctx, p.resolve, sink.Dir(p.dest), p.sources, p.options()...)
+	if err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		fmt.Println(diff)
+	}
+	if len(diffs) > 0 {
+		return errors.Errorf("%s is out of date, %d file(s) differ", p.dest, len(diffs))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync"
+)
+
+type graphCmd struct {
+	Format  string   `short:"f" enum:"dot,json,mermaid" default:"dot" help:"Output format (${enum})."`
+	Output  string   `short:"o" placeholder:"FILE" help:"File to write the graph to (default stdout)."`
+	Sources []string `arg:"" optional:"" help:"Additional proto files to include in the graph."`
+}
+
+func (g *graphCmd) Run(ctx context.Context) error {
+	p, err := loadProject(g.Sources, false)
+	if err != nil {
+		return err
+	}
+	graph, err := protosync.Graph(ctx, p.resolve, p.sources, p.options()...)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if g.Output != "" {
+		f, err := os.Create(g.Output)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch g.Format {
+	case "json":
+		return graph.WriteJSON(w)
+	case "mermaid":
+		return graph.WriteMermaid(w)
+	default:
+		return graph.WriteDOT(w)
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/alecthomas/kong"
+	"github.com/pkg/errors"
 
 	"github.com/cashapp/protosync"
 	"github.com/cashapp/protosync/config"
+	"github.com/cashapp/protosync/lockfile"
 	"github.com/cashapp/protosync/log"
 	"github.com/cashapp/protosync/resolver"
 )
@@ -53,49 +59,110 @@ var cli struct {
 	Config        string            `help:"Protosync config file path." placeholder:"protosync.hcl"`
 	Dest          string            `short:"d" type:"existingdir" placeholder:"DIR" help:"Destination root to sync files to."`
 	Includes      []string          `short:"I" help:"Additional local include roots to search, and scan for dependencies to resolve."`
-	Sources       []string          `arg:"" optional:"" help:"Additional proto files to sync."`
 	NoDefaults    bool              `help:"Don't include the set of default repositories.'"`
+	Jobs          int               `short:"j" default:"8" help:"Maximum number of imports to fetch concurrently."`
+	Offline       bool              `help:"Only use cached remote files and JARs, failing if any are not cached."`
+
+	Sync  syncCmd  `cmd:"" default:"withargs" help:"Sync protos to the destination (default)."`
+	Check checkCmd `cmd:"" help:"Check that the destination is up to date, without modifying it."`
+	Graph graphCmd `cmd:"" help:"Output the import graph of the configured sources."`
+	Why   whyCmd   `cmd:"" help:"Explain why an import is in the closure, by printing the shortest import chains leading to it."`
+	Cache cacheCmd `cmd:"" help:"Inspect and clean the cache of clones, files and JARs."`
 }
 
 func main() {
-	ctx := kong.Parse(&cli, kong.UsageOnError(), kong.Description(fmt.Sprintf(help, indent(config.Schema), indent(builtinConfig))))
+	// Cancel in-flight fetches on interrupt, allowing them to clean up.
+	cancelCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ctx := kong.Parse(&cli,
+		kong.UsageOnError(),
+		kong.Description(fmt.Sprintf(help, indent(config.Schema), indent(builtinConfig))),
+		kong.BindTo(cancelCtx, (*context.Context)(nil)))
+	err := log.Configure(cli.LoggingConfig)
+	ctx.FatalIfErrorf(err)
+	if cli.Offline {
+		ctx.BindTo(resolver.WithOffline(cancelCtx), (*context.Context)(nil))
+	}
+	err = ctx.Run()
+	ctx.FatalIfErrorf(err)
+}
+
+// project is the loaded configuration shared by all commands.
+type project struct {
+	conf     *config.Config
+	dest     string
+	lock     *lockfile.Lock
+	lockPath string
+	resolve  resolver.Resolver
+	sources  []string
+}
+
+// Load the configuration, lock and resolvers.
+//
+// If "update" is true the lock will be ignored.
+func loadProject(extraSources []string, update bool) (*project, error) {
 	var conf *config.Config
 	var err error
+	configPath := cli.Config
+	if configPath == "" {
+		configPath = "protosync.hcl"
+	}
 	if cli.Config == "" {
 		if cli.NoDefaults {
 			conf = &config.Config{}
 		} else if conf, err = loadConfig("protosync.hcl"); err != nil {
-			if os.IsNotExist(err) {
-				conf, err = config.Parse([]byte(builtinConfig), cli.Set)
-				ctx.FatalIfErrorf(err)
-			} else {
-				ctx.FatalIfErrorf(err)
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			if conf, err = config.Parse([]byte(builtinConfig), cli.Set); err != nil {
+				return nil, err
 			}
 		}
 	} else if conf, err = loadConfig(cli.Config); err != nil {
-		ctx.FatalIfErrorf(err)
+		return nil, err
 	}
 	dest := cli.Dest
 	if dest == "" {
 		dest = conf.Dest
 	}
-	if dest == "" {
-		ctx.Fatalf("destination not provided on command line (--dest) or configuration file")
+	lockPath := filepath.Join(filepath.Dir(configPath), lockfile.Filename)
+	lock := &lockfile.Lock{}
+	if !update {
+		if lock, err = lockfile.Load(lockPath); err != nil {
+			return nil, err
+		}
+	}
+	resolvers, sources, err := conf.Pin(lock).Resolve()
+	if err != nil {
+		return nil, err
 	}
-	err = log.Configure(cli.LoggingConfig)
-	ctx.FatalIfErrorf(err)
-	resolvers, sources, err := conf.Resolve()
-	ctx.FatalIfErrorf(err)
 	resolvers = append(resolvers, resolver.Local(cli.Includes))
-	sources = append(sources, cli.Sources...)
+	sources = append(sources, extraSources...)
 	sources = append(sources, cli.Includes...)
 	if len(sources) == 0 {
-		ctx.PrintUsage(false) // nolint: errcheck
-		fmt.Println()
-		ctx.Fatalf("sources not provided on command line (--sources) or configuration file")
+		return nil, errors.New("sources not provided on command line or configuration file")
 	}
-	_, err = protosync.Sync(resolver.Combine(resolvers...), dest, sources...)
-	ctx.FatalIfErrorf(err)
+	return &project{
+		conf:     conf,
+		dest:     dest,
+		lock:     lock,
+		lockPath: lockPath,
+		resolve:  resolver.Combine(resolvers...),
+		sources:  sources,
+	}, nil
+}
+
+// Check that a destination was provided, as required by commands that write to or compare with it.
+func (p *project) requireDest() error {
+	if p.dest == "" {
+		return errors.New("destination not provided on command line (--dest) or configuration file")
+	}
+	return nil
+}
+
+// Options common to all commands that resolve imports.
+func (p *project) options() []protosync.Option {
+	return []protosync.Option{protosync.WithLock(p.lock), protosync.Jobs(cli.Jobs)}
 }
 
 func indent(s string) string {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cashapp/protosync"
+	"github.com/cashapp/protosync/log"
+	"github.com/cashapp/protosync/sink"
+)
+
+type syncCmd struct {
+	Update  bool     `help:"Ignore versions pinned in protosync.lock and re-resolve them, updating the lock."`
+	Prune   bool     `help:"Delete files previously synced to the destination that are no longer imported."`
+	DryRun  bool     `help:"Report what would be fetched and written without modifying the destination."`
+	Sources []string `arg:"" optional:"" help:"Additional proto files to sync."`
+}
+
+func (s *syncCmd) Run(ctx context.Context) error {
+	p, err := loadProject(s.Sources, s.Update)
+	if err != nil {
+		return err
+	}
+	if err := p.requireDest(); err != nil {
+		return err
+	}
+	options := p.options()
+	if s.Prune || p.conf.Prune {
+		options = append(options, protosync.Prune())
+	}
+	if s.DryRun {
+		options = append(options, protosync.DryRun())
+	}
+	results, err := protosync.Sync(ctx, p.resolve, sink.Dir(p.dest), p.sources, options...)
+	if err != nil {
+		return err
+	}
+	if s.DryRun {
+		for _, result := range results {
+			fmt.Printf("%s: %s\n", result.Action, result.Dest)
+		}
+		return nil
+	}
+	changed := 0
+	for _, result := range results {
+		if result.Changed {
+			changed++
+		}
+	}
+	log.Infof("Synced %d files to %s, %d changed", len(results), p.dest, changed)
+	p.conf.RecordRefs(p.lock)
+	return p.lock.Save(p.lockPath)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cashapp/protosync"
+)
+
+type whyCmd struct {
+	Import  string   `arg:"" help:"Import to explain, eg. google/protobuf/descriptor.proto"`
+	Sources []string `arg:"" optional:"" help:"Additional proto files to include in the closure."`
+}
+
+func (w *whyCmd) Run(ctx context.Context) error {
+	p, err := loadProject(w.Sources, false)
+	if err != nil {
+		return err
+	}
+	graph, err := protosync.Graph(ctx, p.resolve, p.sources, p.options()...)
+	if err != nil {
+		return err
+	}
+	chains, err := graph.ShortestChains(w.Import)
+	if err != nil {
+		return err
+	}
+	for i, chain := range chains {
+		if i > 0 {
+			fmt.Println()
+		}
+		if len(chain) == 0 {
+			fmt.Printf("%s is a source\n", w.Import)
+			continue
+		}
+		fmt.Println(chain[0].From)
+		for _, edge := range chain {
+			fmt.Printf("  -> %s (%s)\n", edge.To, edge.Pos)
+		}
+	}
+	return nil
+}
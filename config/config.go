@@ -5,11 +5,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/alecthomas/hcl"
 	"github.com/alecthomas/kong"
 	"github.com/pkg/errors"
 
+	"github.com/cashapp/protosync/lockfile"
+	"github.com/cashapp/protosync/log"
 	"github.com/cashapp/protosync/resolver"
 )
 
@@ -23,10 +27,12 @@ var Schema = func() string {
 // Config represents the protosync index configuration format.
 type Config struct {
 	Dest        string                       `hcl:"dest,optional" help:"Destination where .proto files will be stored."`
+	Prune       bool                         `hcl:"prune,optional" help:"Delete files previously synced to the destination that are no longer imported."`
 	Remote      resolver.RemoteConfig        `hcl:"remote,block" help:"Configuration for remote repositories."`
 	Sources     []string                     `hcl:"sources,optional" help:"List of remote imports or local root globals to resolve imports from."`
 	Include     []string                     `hcl:"include,optional" help:"Globbed local include roots to search for proto files (eg. apps/*/protos)."`
 	Artifactory []resolver.ArtifactoryConfig `hcl:"artifactory,block" help:"Retrieve protos from JAR files in Artifactory."`
+	Maven       []resolver.MavenConfig       `hcl:"maven,block" help:"Retrieve protos from JAR files in Maven repositories."`
 	Repos       []resolver.Repo              `hcl:"repo,block" help:"Defines how to find protos in a source repository."`
 }
 
@@ -39,7 +45,116 @@ func (c *Config) Decode(ctx *kong.DecodeContext) error { // nolint: golint
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	return errors.WithStack(hcl.Unmarshal(data, c))
+	if err := hcl.Unmarshal(data, c); err != nil {
+		return errors.WithStack(err)
+	}
+	return resolver.ValidateRepos(c.Repos)
+}
+
+// Pin returns a copy of the configuration with repositories, Artifactory and Maven artifacts pinned to
+// the versions recorded in a lock file for their configured commit or version.
+//
+// Entries of a source whose configured commit or version has changed since the lock was written are
+// removed from the lock, so that it is re-resolved.
+func (c *Config) Pin(lock *lockfile.Lock) *Config {
+	refs := c.refs()
+	forgotten := map[string]bool{}
+	for _, entry := range append([]lockfile.Entry{}, lock.Imports...) {
+		key := entry.Resolver + " " + entry.Source
+		configured, ok := refs[key]
+		if !ok || contains(configured, entry.Ref) || forgotten[key+" "+entry.Ref] {
+			continue
+		}
+		forgotten[key+" "+entry.Ref] = true
+		quoted := []string{}
+		for _, ref := range configured {
+			quoted = append(quoted, strconv.Quote(ref))
+		}
+		log.Infof("%s changed from %q to %s since %s was written, re-resolving it", entry.Source, entry.Ref, strings.Join(quoted, " or "), lockfile.Filename)
+		lock.Forget(entry.Resolver, entry.Source, entry.Ref)
+	}
+	pinned := *c
+	pinned.Repos = append([]resolver.Repo{}, c.Repos...)
+	for i, repo := range pinned.Repos {
+		if commit, ok := lock.Version("remote", repo.URL, repo.CommitHash); ok {
+			pinned.Repos[i].CommitHash = commit
+		}
+	}
+	pinned.Artifactory = append([]resolver.ArtifactoryConfig{}, c.Artifactory...)
+	for i, artifactory := range pinned.Artifactory {
+		pinned.Artifactory[i].Repositories = append([]resolver.ArtifactoryRepositoryConfig{}, artifactory.Repositories...)
+		for j, repo := range artifactory.Repositories {
+			if version, ok := lock.Version("artifactory", repo.Path, repo.Version); ok {
+				pinned.Artifactory[i].Repositories[j].Version = version
+			}
+		}
+	}
+	pinned.Maven = append([]resolver.MavenConfig{}, c.Maven...)
+	for i, maven := range pinned.Maven {
+		pinned.Maven[i].Artifacts = append([]resolver.MavenArtifactConfig{}, maven.Artifacts...)
+		for j, artifact := range maven.Artifacts {
+			if version, ok := lock.Version("maven", artifact.Path, artifact.Version); ok {
+				pinned.Maven[i].Artifacts[j].Version = version
+			}
+		}
+	}
+	return &pinned
+}
+
+// RecordRefs records the configured commit or version of each repository and artifact in the lock,
+// so that Pin can detect when it changes.
+func (c *Config) RecordRefs(lock *lockfile.Lock) {
+	// The same repository may be configured at several commits, so each import records the commit of
+	// the repository block it is resolved from.
+	for i, entry := range lock.Imports {
+		if entry.Resolver != "remote" {
+			continue
+		}
+		if repo, err := resolver.MatchRepo(c.Repos, entry.Import); err == nil && repo != nil && repo.URL == entry.Source {
+			lock.Imports[i].Ref = repo.CommitHash
+		}
+	}
+	for _, artifactory := range c.Artifactory {
+		for _, repo := range artifactory.Repositories {
+			lock.SetRef("artifactory", repo.Path, repo.Version)
+		}
+	}
+	for _, maven := range c.Maven {
+		for _, artifact := range maven.Artifacts {
+			lock.SetRef("maven", artifact.Path, artifact.Version)
+		}
+	}
+}
+
+// The configured commits or versions of each repository and artifact, keyed by resolver kind and source.
+func (c *Config) refs() map[string][]string {
+	refs := map[string][]string{}
+	add := func(kind, source, ref string) {
+		refs[kind+" "+source] = append(refs[kind+" "+source], ref)
+	}
+	for _, repo := range c.Repos {
+		add("remote", repo.URL, repo.CommitHash)
+	}
+	for _, artifactory := range c.Artifactory {
+		for _, repo := range artifactory.Repositories {
+			add("artifactory", repo.Path, repo.Version)
+		}
+	}
+	for _, maven := range c.Maven {
+		for _, artifact := range maven.Artifacts {
+			add("maven", artifact.Path, artifact.Version)
+		}
+	}
+	return refs
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 // Resolve config to resolvers and glob-expanded sources.
@@ -53,9 +168,10 @@ func (c *Config) Resolve() (resolvers []resolver.Resolver, sources []string, err
 		if downloadURL == "" {
 			downloadURL = artifactory.URL
 		}
-		for _, repo := range artifactory.Repositories {
-			resolvers = append(resolvers, resolver.ArtifactoryJAR(artifactory.URL, downloadURL, repo))
-		}
+		resolvers = append(resolvers, resolver.ArtifactoryJARs(artifactory.URL, downloadURL, artifactory.Repositories, artifactory.Credentials))
+	}
+	for _, maven := range c.Maven {
+		resolvers = append(resolvers, resolver.Maven(maven))
 	}
 	// Glob sources.
 	for _, source := range c.Sources {
@@ -110,5 +226,11 @@ func Parse(config []byte, vars map[string]string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c, errors.WithStack(hcl.UnmarshalAST(ast, c))
+	if err := hcl.UnmarshalAST(ast, c); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := resolver.ValidateRepos(c.Repos); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
@@ -0,0 +1,100 @@
+package config // nolint: testpackage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cashapp/protosync/lockfile"
+	"github.com/cashapp/protosync/resolver"
+)
+
+func TestPin(t *testing.T) {
+	t.Parallel()
+	conf, err := Parse([]byte(`
+repo "https://github.com/acme/foo.git" {
+  prefix = "foo/"
+  commit = "v1.0.0"
+}
+
+repo "https://github.com/acme/bar.git" {
+  prefix = "bar/"
+  commit = "v2.0.0"
+}
+
+artifactory {
+  url = "https://artifactory.example.com"
+  repository "jar-releases/com/acme/protos" {
+    version = "[1.0,2.0)"
+  }
+}
+`), nil)
+	require.NoError(t, err)
+	foo := "https://github.com/acme/foo.git"
+	bar := "https://github.com/acme/bar.git"
+	lock := &lockfile.Lock{Imports: []lockfile.Entry{
+		{Import: "foo/a.proto", Origin: resolver.Origin{Resolver: "remote", Source: foo, Version: "sha-foo"}, Ref: "v1.0.0"},
+		{Import: "bar/b.proto", Origin: resolver.Origin{Resolver: "remote", Source: bar, Version: "sha-bar"}, Ref: "v1.0.0"},
+		{Import: "c.proto", Origin: resolver.Origin{Resolver: "artifactory", Source: "jar-releases/com/acme/protos", Version: "1.2"}, Ref: "[1.0,2.0)"},
+	}}
+
+	pinned := conf.Pin(lock)
+	require.Equal(t, "sha-foo", pinned.Repos[0].CommitHash)
+	require.Equal(t, "1.2", pinned.Artifactory[0].Repositories[0].Version)
+	// bar's commit changed in the config, so it is re-resolved rather than pinned, and not verified.
+	require.Equal(t, "v2.0.0", pinned.Repos[1].CommitHash)
+	_, ok := lock.Get("bar/b.proto")
+	require.False(t, ok)
+	// The configuration itself is unchanged.
+	require.Equal(t, "v1.0.0", conf.Repos[0].CommitHash)
+	require.Equal(t, "[1.0,2.0)", conf.Artifactory[0].Repositories[0].Version)
+
+	lock.Imports = append(lock.Imports, lockfile.Entry{Import: "bar/b.proto", Origin: resolver.Origin{Resolver: "remote", Source: bar, Version: "sha-bar2"}})
+	conf.RecordRefs(lock)
+	entry, ok := lock.Get("bar/b.proto")
+	require.True(t, ok)
+	require.Equal(t, "v2.0.0", entry.Ref)
+	require.Equal(t, "sha-bar2", conf.Pin(lock).Repos[1].CommitHash)
+}
+
+func TestPinRepositoryAtSeveralCommits(t *testing.T) {
+	t.Parallel()
+	conf, err := Parse([]byte(`
+repo "https://github.com/acme/apis.git" {
+  prefix = "v1/"
+  commit = "release-1"
+}
+
+repo "https://github.com/acme/apis.git" {
+  prefix = "v2/"
+  commit = "release-2"
+}
+`), nil)
+	require.NoError(t, err)
+	apis := "https://github.com/acme/apis.git"
+	lock := &lockfile.Lock{Imports: []lockfile.Entry{
+		{Import: "v1/a.proto", Origin: resolver.Origin{Resolver: "remote", Source: apis, Version: "sha-1"}},
+		{Import: "v2/a.proto", Origin: resolver.Origin{Resolver: "remote", Source: apis, Version: "sha-2"}},
+	}}
+	conf.RecordRefs(lock)
+	entry, _ := lock.Get("v1/a.proto")
+	require.Equal(t, "release-1", entry.Ref)
+	entry, _ = lock.Get("v2/a.proto")
+	require.Equal(t, "release-2", entry.Ref)
+
+	// Each repository block is pinned to the commit its own ref was resolved to.
+	pinned := conf.Pin(lock)
+	require.Equal(t, "sha-1", pinned.Repos[0].CommitHash)
+	require.Equal(t, "sha-2", pinned.Repos[1].CommitHash)
+	require.Len(t, lock.Imports, 2)
+
+	// Changing one block's ref only re-resolves that block.
+	conf.Repos[1].CommitHash = "release-3"
+	pinned = conf.Pin(lock)
+	require.Equal(t, "sha-1", pinned.Repos[0].CommitHash)
+	require.Equal(t, "release-3", pinned.Repos[1].CommitHash)
+	_, ok := lock.Get("v1/a.proto")
+	require.True(t, ok)
+	_, ok = lock.Get("v2/a.proto")
+	require.False(t, ok)
+}
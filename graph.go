@@ -0,0 +1,201 @@
+package protosync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/participle/lexer"
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/resolver"
+	"github.com/cashapp/protosync/sink"
+)
+
+// ImportGraph is the import graph of a set of sources.
+type ImportGraph struct {
+	// Roots are the IDs of the nodes that were explicitly requested, ie. local files and source imports.
+	Roots []string     `json:"roots"`
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []GraphEdge  `json:"edges"`
+}
+
+// GraphNode is a single .proto file in the import graph.
+type GraphNode struct {
+	// ID is the import path of a remote node, or the file path of a local node.
+	ID string `json:"id"`
+	// Local is true if the file is in one of the local source roots.
+	Local bool `json:"local"`
+	// Name of the resolved source of a remote node, eg. a URL.
+	Name string `json:"name,omitempty"`
+	// Origin of a remote node.
+	Origin *resolver.Origin `json:"origin,omitempty"`
+}
+
+// GraphEdge is an import statement.
+type GraphEdge struct {
+	// From is the ID of the importing node.
+	From string `json:"from"`
+	// To is the ID of the imported node.
+	To string `json:"to"`
+	// Pos of the import statement in the importing file.
+	Pos lexer.Position `json:"pos"`
+}
+
+// Graph resolves the import closure of sources exactly like Sync, but returns the import graph rather than
+// writing any files.
+func Graph(ctx context.Context, resolve resolver.Resolver, sources []string, options ...Option) (*ImportGraph, error) {
+	s := newSyncer(ctx, resolve, sink.Memory(), sources, options)
+	s.write = func(s *syncer, result SyncResult, data []byte) (FileAction, error) { return FileUnchanged, nil }
+	if err := s.run(); err != nil {
+		return nil, err
+	}
+	return s.graph(), nil
+}
+
+func (s *syncer) graph() *ImportGraph {
+	graph := &ImportGraph{Edges: append([]GraphEdge{}, s.edges...)}
+	for _, node := range s.nodes {
+		graph.Nodes = append(graph.Nodes, node)
+		if node.Local {
+			graph.Roots = append(graph.Roots, node.ID)
+		}
+	}
+	graph.Roots = append(graph.Roots, s.imports...)
+	sort.Strings(graph.Roots)
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+	sort.SliceStable(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].From != graph.Edges[j].From {
+			return graph.Edges[i].From < graph.Edges[j].From
+		}
+		return graph.Edges[i].To < graph.Edges[j].To
+	})
+	return graph
+}
+
+// ShortestChains returns every shortest chain of imports from one of the graph's roots to the node "id".
+//
+// Each chain is the sequence of import statements leading to the node, and will be empty if the node
+// is itself a root. An error is returned if the node is not in the graph.
+func (g *ImportGraph) ShortestChains(id string) ([][]GraphEdge, error) {
+	// Breadth-first search from all roots simultaneously, recording the distance to each node.
+	outgoing := map[string][]GraphEdge{}
+	for _, edge := range g.Edges {
+		outgoing[edge.From] = append(outgoing[edge.From], edge)
+	}
+	distance := map[string]int{}
+	queue := []string{}
+	for _, root := range g.Roots {
+		if _, ok := distance[root]; !ok {
+			distance[root] = 0
+			queue = append(queue, root)
+		}
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, edge := range outgoing[node] {
+			if _, ok := distance[edge.To]; !ok {
+				distance[edge.To] = distance[node] + 1
+				queue = append(queue, edge.To)
+			}
+		}
+	}
+	if _, ok := distance[id]; !ok {
+		return nil, errors.Errorf("%s is not in the import closure", id)
+	}
+	// Walk backwards from the node along edges that decrease the distance by one.
+	incoming := map[string][]GraphEdge{}
+	for _, edge := range g.Edges {
+		if from, ok := distance[edge.From]; ok && from+1 == distance[edge.To] {
+			incoming[edge.To] = append(incoming[edge.To], edge)
+		}
+	}
+	var chains func(id string) [][]GraphEdge
+	chains = func(id string) [][]GraphEdge {
+		if distance[id] == 0 {
+			return [][]GraphEdge{{}}
+		}
+		out := [][]GraphEdge{}
+		for _, edge := range incoming[id] {
+			for _, chain := range chains(edge.From) {
+				out = append(out, append(append([]GraphEdge{}, chain...), edge))
+			}
+		}
+		return out
+	}
+	return chains(id), nil
+}
+
+// WriteJSON writes the graph as JSON.
+func (g *ImportGraph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.WithStack(enc.Encode(g))
+}
+
+// WriteDOT writes the graph in Graphviz DOT format.
+//
+// Local nodes are drawn as boxes, remote nodes as ellipses labelled with the resolver that served them.
+func (g *ImportGraph) WriteDOT(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "digraph imports {")
+	fmt.Fprintln(b, "  rankdir=LR;")
+	for _, node := range g.Nodes {
+		if node.Local {
+			fmt.Fprintf(b, "  %q [shape=box, label=%q];\n", node.ID, node.ID+"\n(local)")
+		} else {
+			fmt.Fprintf(b, "  %q [shape=ellipse, label=%q];\n", node.ID, node.ID+"\n("+node.label()+")")
+		}
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(b, "  %q -> %q;\n", edge.From, edge.To)
+	}
+	fmt.Fprintln(b, "}")
+	_, err := io.WriteString(w, b.String())
+	return errors.WithStack(err)
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart.
+//
+// Local and remote nodes are assigned the "local" and "remote" classes respectively.
+func (g *ImportGraph) WriteMermaid(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "flowchart LR")
+	ids := map[string]string{}
+	for i, node := range g.Nodes {
+		id := fmt.Sprintf("n%d", i)
+		ids[node.ID] = id
+		if node.Local {
+			fmt.Fprintf(b, "  %s[\"%s<br/>(local)\"]:::local\n", id, mermaidEscape(node.ID))
+		} else {
+			fmt.Fprintf(b, "  %s([\"%s<br/>(%s)\"]):::remote\n", id, mermaidEscape(node.ID), mermaidEscape(node.label()))
+		}
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(b, "  %s --> %s\n", ids[edge.From], ids[edge.To])
+	}
+	fmt.Fprintln(b, "  classDef local fill:#eee,stroke:#333")
+	fmt.Fprintln(b, "  classDef remote fill:#def,stroke:#36c")
+	_, err := io.WriteString(w, b.String())
+	return errors.WithStack(err)
+}
+
+// Label describing the resolver that served a remote node.
+func (n *GraphNode) label() string {
+	if n.Origin == nil {
+		return "unknown"
+	}
+	label := n.Origin.Resolver + ": " + n.Origin.Source
+	if n.Origin.Version != "" {
+		label += "@" + n.Origin.Version
+	}
+	return label
+}
+
+func mermaidEscape(s string) string {
+	return strings.ReplaceAll(s, `"`, "#quot;")
+}
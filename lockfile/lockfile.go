@@ -0,0 +1,100 @@
+// Package lockfile contains the protosync.lock format, which pins every synced import to an exact source and content hash.
+package lockfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/resolver"
+)
+
+// Filename of the lock file, written next to the configuration file.
+const Filename = "protosync.lock"
+
+// Lock pins each import in a synced closure to the exact source it was retrieved from.
+type Lock struct {
+	Imports []Entry `json:"imports"`
+}
+
+// Entry is a single locked import.
+type Entry struct {
+	Import string `json:"import"`
+	resolver.Origin
+	// Ref is the configured commit or version that Version was resolved from, eg. a branch, tag or
+	// version range.
+	Ref    string `json:"ref,omitempty"`
+	SHA256 string `json:"sha256"`
+}
+
+// Load a lock file.
+//
+// A missing lock file is not an error, an empty Lock is returned instead.
+func Load(path string) (*Lock, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Lock{}, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	lock := &Lock{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return lock, nil
+}
+
+// Save the lock file, with entries sorted by import.
+func (l *Lock) Save(path string) error {
+	sort.Slice(l.Imports, func(i, j int) bool { return l.Imports[i].Import < l.Imports[j].Import })
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(path, append(data, '\n'), 0o644))
+}
+
+// Get the locked entry for an import.
+func (l *Lock) Get(imp string) (Entry, bool) {
+	for _, entry := range l.Imports {
+		if entry.Import == imp {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Version returns the locked version of a source configured at a ref, eg. the commit SHA a branch of a
+// repository was resolved to.
+func (l *Lock) Version(resolverKind, source, ref string) (string, bool) {
+	for _, entry := range l.Imports {
+		if entry.Resolver == resolverKind && entry.Source == source && entry.Ref == ref && entry.Version != "" {
+			return entry.Version, true
+		}
+	}
+	return "", false
+}
+
+// SetRef records the configured ref of every entry from a source.
+func (l *Lock) SetRef(resolverKind, source, ref string) {
+	for i, entry := range l.Imports {
+		if entry.Resolver == resolverKind && entry.Source == source {
+			l.Imports[i].Ref = ref
+		}
+	}
+}
+
+// Forget every entry from a source configured at a ref, so that it is re-resolved and its content is
+// not verified.
+func (l *Lock) Forget(resolverKind, source, ref string) {
+	imports := l.Imports[:0]
+	for _, entry := range l.Imports {
+		if entry.Resolver != resolverKind || entry.Source != source || entry.Ref != ref {
+			imports = append(imports, entry)
+		}
+	}
+	l.Imports = imports
+}
@@ -2,22 +2,106 @@
 package protosync
 
 import (
-	"io"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 
+	"github.com/cashapp/protosync/lockfile"
 	"github.com/cashapp/protosync/log"
 	"github.com/cashapp/protosync/parser"
 	"github.com/cashapp/protosync/resolver"
+	"github.com/cashapp/protosync/sink"
 )
 
+// DefaultJobs is the default maximum number of concurrent fetches.
+const DefaultJobs = 8
+
+// An Option for Sync.
+type Option func(s *syncer)
+
+// Jobs sets the maximum number of imports that will be fetched concurrently.
+func Jobs(n int) Option {
+	return func(s *syncer) {
+		if n > 0 {
+			s.jobs = n
+		}
+	}
+}
+
+// DryRun resolves and compares files against the destination as usual, but does not modify it.
+//
+// The Action of each SyncResult reports what would have been done.
+func DryRun() Option {
+	return func(s *syncer) { s.dryRun = true }
+}
+
+// WithLock verifies synced content against the entries in lock, then replaces them with the synced closure.
+//
+// Pass an empty Lock to record the closure without verifying it.
+func WithLock(lock *lockfile.Lock) Option {
+	return func(s *syncer) { s.lock = lock }
+}
+
+// FileAction describes what a sync did, or would do, to a file in the destination.
+type FileAction string
+
+// Actions on destination files.
+const (
+	FileCreated     FileAction = "create"
+	FileOverwritten FileAction = "overwrite"
+	FileUnchanged   FileAction = "unchanged"
+)
+
+// SyncResult describes a single file synced into the destination.
+type SyncResult struct {
+	// Import path of the file.
+	Import string
+	// Dest is the location the file was written to.
+	Dest string
+	// Name of the resolved source, eg. a URL.
+	Name string
+	// Origin the file was resolved from, including the kind of resolver.
+	Origin resolver.Origin
+	// Size of the file in bytes.
+	Size int
+	// SHA256 of the file content, hex encoded.
+	SHA256 string
+	// Action taken, or that would be taken in a dry run, on the destination file.
+	Action FileAction
+	// Changed is true if the file did not previously exist in the destination with the same content.
+	Changed bool
+	// ImportedBy lists the import paths of synced files, or paths of local files, that import this file.
+	ImportedBy []string
+}
+
 // Sync a set of remote protobuf imports and/or recursively resolved local roots to dest.
 //
-// Returns the list of files synchronised into dest.
-func Sync(resolve resolver.Resolver, dest string, sources ...string) ([]string, error) {
+// Use sink.Dir() to sync to a local directory.
+//
+// Returns a result for each file synchronised into dest, ordered by import path.
+func Sync(ctx context.Context, resolve resolver.Resolver, dest sink.Sink, sources []string, options ...Option) ([]SyncResult, error) {
+	s := newSyncer(ctx, resolve, dest, sources, options)
+	s.write = writeFile
+	if err := s.run(); err != nil {
+		return nil, err
+	}
+	if err := updateManifest(s); err != nil {
+		return nil, err
+	}
+	return s.results, nil
+}
+
+func newSyncer(ctx context.Context, resolve resolver.Resolver, dest sink.Sink, sources []string, options []Option) *syncer {
 	roots := []string{}
 	imports := []string{}
 	for _, src := range sources {
@@ -27,39 +111,174 @@ func Sync(resolve resolver.Resolver, dest string, sources ...string) ([]string,
 			roots = append(roots, src)
 		}
 	}
-	ctx := &context{
-		dest:     dest,
-		roots:    roots,
-		resolved: map[string]bool{},
-		resolve:  resolve,
+	s := &syncer{
+		ctx:       ctx,
+		jobs:      DefaultJobs,
+		imports:   imports,
+		dest:      dest,
+		roots:     roots,
+		resolved:  map[string]bool{},
+		importers: map[string][]string{},
+		nodes:     map[string]*GraphNode{},
+		resolve:   resolve,
 	}
-	for _, src := range imports {
-		err := recursiveResolve(ctx, src)
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+type syncer struct {
+	ctx      context.Context
+	jobs     int
+	imports  []string
+	roots    []string
+	resolved map[string]bool
+	// Import path to the files that import it.
+	importers map[string][]string
+	results   []SyncResult
+	resolve   resolver.Resolver
+	dest      sink.Sink
+	lock      *lockfile.Lock
+	locked    []lockfile.Entry
+	prune     bool
+	dryRun    bool
+	nodes     map[string]*GraphNode
+	edges     []GraphEdge
+	// Called with the content of each resolved import.
+	write func(s *syncer, result SyncResult, data []byte) (FileAction, error)
+}
+
+// Resolve the closure of all imports and local roots.
+//
+// Each level of the import graph is fetched concurrently, but results are processed in
+// import order so that output is deterministic.
+func (s *syncer) run() error {
+	queue := []pending{}
+	for _, src := range s.imports {
+		queue = s.enqueue(queue, src, "")
+	}
+	for _, root := range s.roots {
+		var err error
+		queue, err = resolveLocalRoot(s, root, queue)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	for _, root := range roots {
-		err := resolveLocalRoot(ctx, root)
-		if err != nil {
-			return nil, err
+	for len(queue) > 0 {
+		if err := s.ctx.Err(); err != nil {
+			return errors.WithStack(err)
 		}
+		results := s.fetchAll(queue)
+		next := []pending{}
+		for i, p := range queue {
+			f := results[i]
+			if f.err != nil {
+				if p.pos != "" {
+					return errors.Wrap(f.err, p.pos)
+				}
+				return f.err
+			}
+			sum := sha256.Sum256(f.data)
+			result := SyncResult{
+				Import: p.imp,
+				Dest:   s.dest.Location(p.imp),
+				Name:   f.name,
+				Origin: f.origin,
+				Size:   len(f.data),
+				SHA256: hex.EncodeToString(sum[:]),
+			}
+			if err := lockImport(s, result); err != nil {
+				return err
+			}
+			s.nodes[p.imp] = &GraphNode{ID: p.imp, Name: f.name, Origin: &result.Origin}
+			action, err := s.write(s, result, f.data)
+			if err != nil {
+				return err
+			}
+			result.Action = action
+			result.Changed = action != FileUnchanged
+			s.results = append(s.results, result)
+			next = resolveImports(s, p.imp, f.proto, next)
+		}
+		queue = next
+	}
+	for i, result := range s.results {
+		s.results[i].ImportedBy = s.importers[result.Import]
 	}
-	synced := []string{}
-	for imp := range ctx.resolved {
-		synced = append(synced, imp)
+	sort.Slice(s.results, func(i, j int) bool { return s.results[i].Import < s.results[j].Import })
+	if s.lock != nil {
+		s.lock.Imports = append([]lockfile.Entry{}, s.locked...)
 	}
-	return synced, nil
+	return nil
 }
 
-type context struct {
-	roots    []string
-	resolved map[string]bool
-	resolve  resolver.Resolver
-	dest     string
+// An import waiting to be resolved.
+type pending struct {
+	imp string
+	// Position of the first import statement referencing imp, if any.
+	pos string
+}
+
+// An import that has been retrieved and parsed.
+type fetched struct {
+	name   string
+	origin resolver.Origin
+	data   []byte
+	proto  *parser.Proto
+	err    error
 }
 
-func resolveLocalRoot(ctx *context, root string) error {
+// Add an import to the queue if it has not already been seen.
+func (s *syncer) enqueue(queue []pending, imp, pos string) []pending {
+	if s.resolved[imp] {
+		return queue
+	}
+	s.resolved[imp] = true
+	return append(queue, pending{imp: imp, pos: pos})
+}
+
+// Fetch all queued imports, with at most s.jobs in flight.
+func (s *syncer) fetchAll(queue []pending) []fetched {
+	results := make([]fetched, len(queue))
+	sem := make(chan struct{}, s.jobs)
+	wg := sync.WaitGroup{}
+	for i, p := range queue {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, imp string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = fetch(s, imp)
+		}(i, p.imp)
+	}
+	wg.Wait()
+	return results
+}
+
+func fetch(s *syncer, imp string) fetched {
+	r, err := s.resolve(s.ctx, imp)
+	if err != nil {
+		return fetched{err: errors.Wrapf(err, imp)}
+	}
+	if r == nil {
+		return fetched{err: errors.Errorf("could not resolve %q, may need resolver config to be updated", imp)}
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fetched{err: errors.Wrap(err, r.Name())}
+	}
+	proto, err := parser.Parse(bytes.NewReader(data))
+	if err != nil {
+		return fetched{err: errors.Wrap(err, r.Name())}
+	}
+	return fetched{name: r.Name(), origin: resolver.OriginOf(r), data: data, proto: proto}
+}
+
+func resolveLocalRoot(s *syncer, root string, queue []pending) ([]pending, error) {
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return errors.WithStack(err)
@@ -72,16 +291,19 @@ func resolveLocalRoot(ctx *context, root string) error {
 			return errors.WithStack(err)
 		}
 		defer r.Close()
-		return resolveImports(ctx, r)
+		proto, err := parser.Parse(r)
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+		s.nodes[path] = &GraphNode{ID: path, Local: true}
+		queue = resolveImports(s, path, proto, queue)
+		return nil
 	})
-	return errors.WithStack(err)
+	return queue, errors.WithStack(err)
 }
 
-func resolveImports(ctx *context, r io.Reader) error {
-	proto, err := parser.Parse(r)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+// Queue all non-local imports of proto, which was imported as or loaded from "importer".
+func resolveImports(s *syncer, importer string, proto *parser.Proto, queue []pending) []pending {
 	pkg := ""
 nextImport:
 	for _, stmt := range proto.Entries {
@@ -92,63 +314,63 @@ nextImport:
 		if stmt.Import == "" {
 			continue
 		}
+		pos := stmt.Pos
+		pos.Filename = importer
 		// Skip local imports.
-		for _, root := range ctx.roots {
+		for _, root := range s.roots {
 			rootImport := filepath.Join(root, stmt.Import)
 			if _, err := os.Stat(rootImport); err == nil {
 				log.Tracef("%s imports %s (local %s)", pkg, stmt.Import, rootImport)
+				s.edges = append(s.edges, GraphEdge{From: importer, To: rootImport, Pos: pos})
 				continue nextImport
 			}
 		}
-		if ctx.resolved[stmt.Import] {
+		if s.resolved[stmt.Import] {
 			log.Tracef("%s imports %s (cached)", pkg, stmt.Import)
 		} else {
 			log.Tracef("%s imports %s (fetch)", pkg, stmt.Import)
 		}
-		err := recursiveResolve(ctx, stmt.Import)
-		if err != nil {
-			return errors.Wrap(err, stmt.Pos.String())
-		}
+		s.importers[stmt.Import] = append(s.importers[stmt.Import], importer)
+		s.edges = append(s.edges, GraphEdge{From: importer, To: stmt.Import, Pos: pos})
+		queue = s.enqueue(queue, stmt.Import, pos.String())
 	}
-	return nil
+	return queue
 }
 
-func recursiveResolve(ctx *context, imp string) error {
-	if ctx.resolved[imp] {
-		return nil
-	}
-	r, err := ctx.resolve(imp)
-	if err != nil {
-		return errors.Wrapf(err, imp)
-	}
-	if r == nil {
-		return errors.Errorf("could not resolve %q, may need resolver config to be updated", imp)
+func writeFile(s *syncer, result SyncResult, data []byte) (FileAction, error) {
+	log.Infof("%s -> %s", result.Name, result.Dest)
+	action := FileCreated
+	existing, err := fs.ReadFile(s.dest, result.Import)
+	if err == nil {
+		if bytes.Equal(existing, data) {
+			return FileUnchanged, nil
+		}
+		action = FileOverwritten
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", errors.WithStack(err)
 	}
-	ctx.resolved[imp] = true
-	defer r.Close()
-	destFile := filepath.Join(ctx.dest, imp)
-	err = os.MkdirAll(filepath.Dir(destFile), os.ModePerm)
-	if err != nil {
-		return errors.WithStack(err)
+	if s.dryRun {
+		return action, nil
 	}
-	log.Infof("%s -> %s", r.Name(), destFile)
-	w, err := os.Create(destFile)
-	if err != nil {
-		return errors.WithStack(err)
+	return action, errors.WithStack(s.dest.WriteFile(result.Import, data))
+}
+
+// Verify content against the lock, if any, and record its origin.
+//
+// Local files are recorded but not verified, as they are edited in place rather than pinned.
+func lockImport(s *syncer, result SyncResult) error {
+	if s.lock == nil {
+		return nil
 	}
-	defer w.Close()
-	_, err = io.Copy(w, r)
-	if err != nil {
-		return errors.WithStack(err)
+	entry := lockfile.Entry{
+		Import: result.Import,
+		Origin: result.Origin,
+		SHA256: result.SHA256,
 	}
-	_ = w.Close()
-	_ = r.Close()
-
-	// Recursively resolve imports.
-	r, err = os.Open(destFile)
-	if err != nil {
-		return errors.WithStack(err)
+	if locked, ok := s.lock.Get(result.Import); ok && locked.SHA256 != entry.SHA256 && entry.Resolver != "local" {
+		return errors.Errorf("%s: content of %s does not match %s (expected sha256 %s but got %s), the lock may need to be updated",
+			result.Import, result.Name, lockfile.Filename, locked.SHA256, entry.SHA256)
 	}
-	defer r.Close()
-	return resolveImports(ctx, r)
+	s.locked = append(s.locked, entry)
+	return nil
 }
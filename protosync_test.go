@@ -0,0 +1,245 @@
+package protosync // nolint: testpackage
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cashapp/protosync/lockfile"
+	"github.com/cashapp/protosync/resolver"
+	"github.com/cashapp/protosync/sink"
+)
+
+type memoryProto struct {
+	*strings.Reader
+	name string
+}
+
+func (m *memoryProto) Name() string { return m.name }
+func (m *memoryProto) Close() error { return nil }
+
+func memoryResolver(files map[string]string) resolver.Resolver {
+	return func(ctx context.Context, path string) (resolver.NamedReadCloser, error) {
+		content, ok := files[path]
+		if !ok {
+			return nil, nil
+		}
+		return &memoryProto{Reader: strings.NewReader(content), name: "memory:" + path}, nil
+	}
+}
+
+// Files for a closure of a.proto importing b.proto.
+func twoFileClosure() map[string]string {
+	return map[string]string{
+		"a.proto": `syntax = "proto3"; import "b.proto";`,
+		"b.proto": `syntax = "proto3";`,
+	}
+}
+
+func TestSyncLock(t *testing.T) {
+	t.Parallel()
+	files := twoFileClosure()
+	dest := t.TempDir()
+	lock := &lockfile.Lock{}
+	results, err := Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"}, WithLock(lock))
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "b.proto", results[1].Import)
+	require.Equal(t, []string{"a.proto"}, results[1].ImportedBy)
+	require.True(t, results[1].Changed)
+	require.Len(t, lock.Imports, 2)
+	entry, ok := lock.Get("b.proto")
+	require.True(t, ok)
+	require.Equal(t, "memory:b.proto", entry.Source)
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "b.proto"))
+	require.NoError(t, err)
+	require.Equal(t, files["b.proto"], string(data))
+
+	results, err = Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"}, WithLock(lock))
+	require.NoError(t, err)
+	require.False(t, results[1].Changed)
+
+	files["b.proto"] = `syntax = "proto2";`
+	_, err = Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"}, WithLock(lock))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match protosync.lock")
+}
+
+func TestSyncLockLocal(t *testing.T) {
+	t.Parallel()
+	include := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(include, "b.proto"), []byte(`syntax = "proto3";`), 0o600)
+	require.NoError(t, err)
+	resolve := resolver.Combine(memoryResolver(map[string]string{"a.proto": `syntax = "proto3"; import "b.proto";`}), resolver.Local([]string{include}))
+	dest := t.TempDir()
+	lock := &lockfile.Lock{}
+	_, err = Sync(context.Background(), resolve, sink.Dir(dest), []string{"a.proto"}, WithLock(lock))
+	require.NoError(t, err)
+	entry, ok := lock.Get("b.proto")
+	require.True(t, ok)
+	require.Equal(t, "local", entry.Resolver)
+
+	// Editing a local include does not require the lock to be updated.
+	err = ioutil.WriteFile(filepath.Join(include, "b.proto"), []byte(`syntax = "proto2";`), 0o600)
+	require.NoError(t, err)
+	_, err = Sync(context.Background(), resolve, sink.Dir(dest), []string{"a.proto"}, WithLock(lock))
+	require.NoError(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+	files := twoFileClosure()
+	dest := t.TempDir()
+	_, err := Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"})
+	require.NoError(t, err)
+	diffs, err := Check(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"})
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+
+	files["a.proto"] = `syntax = "proto3"; import "c.proto";`
+	files["c.proto"] = `syntax = "proto3";`
+	diffs, err = Check(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"})
+	require.NoError(t, err)
+	require.Equal(t, []Difference{
+		{Kind: Changed, Import: "a.proto"},
+		{Kind: Extraneous, Import: "b.proto"},
+		{Kind: Missing, Import: "c.proto"},
+	}, diffs)
+}
+
+func TestSyncPrune(t *testing.T) {
+	t.Parallel()
+	files := twoFileClosure()
+	dest := t.TempDir()
+	_, err := Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"})
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(dest, ManifestFile))
+	_, err = Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"}, Prune())
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dest, ManifestFile))
+	err = ioutil.WriteFile(filepath.Join(dest, "mine.proto"), nil, 0o600)
+	require.NoError(t, err)
+
+	// Syncs without pruning leave stale files, and the manifest, alone.
+	files["a.proto"] = `syntax = "proto3";`
+	_, err = Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"})
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dest, "b.proto"))
+
+	_, err = Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"}, Prune())
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(dest, "b.proto"))
+	require.FileExists(t, filepath.Join(dest, "a.proto"))
+	require.FileExists(t, filepath.Join(dest, "mine.proto"))
+
+	// Manifest entries outside the destination, or that aren't protos, are never pruned.
+	outside := filepath.Join(t.TempDir(), "outside.proto")
+	require.NoError(t, ioutil.WriteFile(outside, nil, 0o600))
+	rel, err := filepath.Rel(dest, outside)
+	require.NoError(t, err)
+	manifest := filepath.ToSlash(rel) + "\nmine.txt\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, ManifestFile), []byte(manifest), 0o600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "mine.txt"), nil, 0o600))
+	_, err = Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"}, Prune())
+	require.NoError(t, err)
+	require.FileExists(t, outside)
+	require.FileExists(t, filepath.Join(dest, "mine.txt"))
+}
+
+func TestSyncCancelled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resolve := resolver.Combine(memoryResolver(map[string]string{"a.proto": `syntax = "proto3";`}))
+	_, err := Sync(ctx, resolve, sink.Dir(t.TempDir()), []string{"a.proto"})
+	require.True(t, errors.Is(err, context.Canceled), "%v", err)
+}
+
+func TestGraph(t *testing.T) {
+	t.Parallel()
+	files := map[string]string{
+		"a.proto": `syntax = "proto3"; import "b.proto"; import "c.proto";`,
+		"b.proto": `syntax = "proto3"; import "c.proto";`,
+		"c.proto": `syntax = "proto3";`,
+	}
+	graph, err := Graph(context.Background(), memoryResolver(files), []string{"a.proto"})
+	require.NoError(t, err)
+	require.Len(t, graph.Nodes, 3)
+	edges := []string{}
+	for _, edge := range graph.Edges {
+		edges = append(edges, edge.Pos.String()+" "+edge.From+" -> "+edge.To)
+	}
+	require.Equal(t, []string{
+		"a.proto:1:20 a.proto -> b.proto",
+		"a.proto:1:38 a.proto -> c.proto",
+		"b.proto:1:20 b.proto -> c.proto",
+	}, edges)
+	chains, err := graph.ShortestChains("c.proto")
+	require.NoError(t, err)
+	require.Len(t, chains, 1)
+	require.Equal(t, "a.proto", chains[0][0].From)
+	require.Len(t, chains[0], 1)
+	_, err = graph.ShortestChains("d.proto")
+	require.Error(t, err)
+
+	w := &strings.Builder{}
+	require.NoError(t, graph.WriteDOT(w))
+	require.Contains(t, w.String(), `"a.proto" -> "b.proto";`)
+}
+
+func TestSyncDryRun(t *testing.T) {
+	t.Parallel()
+	files := twoFileClosure()
+	dest := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dest, "a.proto"), []byte(files["a.proto"]), 0o600)
+	require.NoError(t, err)
+	results, err := Sync(context.Background(), memoryResolver(files), sink.Dir(dest), []string{"a.proto"}, DryRun())
+	require.NoError(t, err)
+	require.Equal(t, FileUnchanged, results[0].Action)
+	require.Equal(t, FileCreated, results[1].Action)
+	require.NoFileExists(t, filepath.Join(dest, "b.proto"))
+	require.NoFileExists(t, filepath.Join(dest, ManifestFile))
+}
+
+func TestSyncToMemory(t *testing.T) {
+	t.Parallel()
+	files := map[string]string{
+		"a.proto":     `syntax = "proto3"; import "dir/b.proto";`,
+		"dir/b.proto": `syntax = "proto3";`,
+	}
+	dest := sink.Memory()
+	_, err := Sync(context.Background(), memoryResolver(files), dest, []string{"a.proto"})
+	require.NoError(t, err)
+	data, err := fs.ReadFile(dest, "dir/b.proto")
+	require.NoError(t, err)
+	require.Equal(t, files["dir/b.proto"], string(data))
+	diffs, err := Check(context.Background(), memoryResolver(files), dest, []string{"a.proto"})
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+}
+
+func TestSyncToArchive(t *testing.T) {
+	t.Parallel()
+	files := twoFileClosure()
+	buf := &bytes.Buffer{}
+	dest := sink.Zip(buf)
+	_, err := Sync(context.Background(), memoryResolver(files), dest, []string{"a.proto"}, Prune())
+	require.NoError(t, err)
+	require.NoError(t, dest.Close())
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	names := []string{}
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	require.Equal(t, []string{"a.proto", "b.proto"}, names)
+}
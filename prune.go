@@ -0,0 +1,82 @@
+package protosync
+
+import (
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/log"
+	"github.com/cashapp/protosync/sink"
+)
+
+// ManifestFile is the name of the file in the destination that records which files protosync owns.
+const ManifestFile = ".protosync-manifest"
+
+// Prune files owned by protosync from the destination if they are no longer in the resolved closure.
+//
+// Ownership is recorded in ManifestFile by each pruning sync, so files are only pruned once a
+// previous pruning sync has written them. Files that protosync did not write are never touched.
+func Prune() Option {
+	return func(s *syncer) { s.prune = true }
+}
+
+// Prune stale files and update the manifest of files owned by protosync, if pruning is enabled.
+//
+// Only persistent sinks have a manifest, so pruning is a no-op for archives and in-memory sinks.
+func updateManifest(s *syncer) error {
+	if _, ok := s.dest.(sink.Persistent); !ok || !s.prune {
+		return nil
+	}
+	owned, err := readManifest(s.dest)
+	if err != nil {
+		return err
+	}
+	files := []string{}
+	for imp := range s.resolved {
+		files = append(files, imp)
+	}
+	for _, imp := range owned {
+		if s.resolved[imp] {
+			continue
+		}
+		if s.dryRun {
+			log.Infof("prune %s (dry run)", s.dest.Location(imp))
+			continue
+		}
+		log.Infof("prune %s", s.dest.Location(imp))
+		if err := s.dest.Remove(imp); err != nil {
+			return errors.Wrap(err, imp)
+		}
+	}
+	if s.dryRun {
+		return nil
+	}
+	sort.Strings(files)
+	data := []byte{}
+	if len(files) > 0 {
+		data = []byte(strings.Join(files, "\n") + "\n")
+	}
+	return errors.WithStack(s.dest.WriteFile(ManifestFile, data))
+}
+
+func readManifest(dest sink.Sink) ([]string, error) {
+	data, err := fs.ReadFile(dest, ManifestFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	owned := []string{}
+	for _, name := range strings.Fields(string(data)) {
+		// The manifest may be edited by hand, so never prune anything but .proto files in the destination.
+		if !fs.ValidPath(name) || path.Ext(name) != ".proto" {
+			log.Warnf("Ignoring invalid entry %q in %s", name, dest.Location(ManifestFile))
+			continue
+		}
+		owned = append(owned, name)
+	}
+	return owned, nil
+}
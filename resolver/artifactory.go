@@ -2,13 +2,18 @@ package resolver
 
 import (
 	"archive/zip"
-	"encoding/xml"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 
@@ -20,13 +25,11 @@ type ArtifactoryConfig struct {
 	URL          string                        `hcl:"url" help:"Artifactory URL, eg. \"https://artifactory.mycompany.com/artifactory\""`
 	DownloadURL  string                        `hcl:"download_url,optional" help:"Optional URL to download artifacts from. If not provided Artifactory itself will be used."`
 	Repositories []ArtifactoryRepositoryConfig `hcl:"repository,block" help:"Artifactory repositories to download the latest JAR from."`
+	Credentials  []CredentialConfig            `hcl:"credentials,block" help:"Credentials for Artifactory and the download host. $ARTIFACTORY_API_KEY and ~/.netrc are used by default."`
 }
 
 // ArtifactoryRepositoryConfig is the config for a single repository within Artifactory.
-type ArtifactoryRepositoryConfig struct {
-	Path    string `hcl:"name,label" help:"Artifact repository name."`
-	Version string `hcl:"version,optional" help:"The artifact version to use."`
-}
+type ArtifactoryRepositoryConfig = MavenArtifactConfig
 
 // ArtifactoryJAR resolves protobufs from JAR files in Artifactory.
 //
@@ -36,132 +39,334 @@ type ArtifactoryRepositoryConfig struct {
 // eg. "https://artifactory.mycompany.com/artifactory".
 // "jarURL" should have the same URL layout as Artifactory, but could be a JAR mirror,
 // eg. "https://edge-cache.mycompany.com/artifactory".
-// "repositoryPath" is the Artifactory repository path to the artifact we're retrieving,
-// eg. "jar-releases/com/mycompany/external/protos/mycompany-protos" or "mycompany-public/com/mycompany/protos/all-protos"
-func ArtifactoryJAR(artifactoryURL, jarURL string, repository ArtifactoryRepositoryConfig) Resolver {
-	var jarPath string
-	var zipFile *zip.ReadCloser
-	return func(path string) (NamedReadCloser, error) {
-		if zipFile == nil {
-			var err error
-			jarPath, zipFile, err = openJAR(artifactoryURL, jarURL, repository)
-			if err != nil {
-				return nil, errors.Wrap(err, jarURL)
-			}
-		}
-		for _, file := range zipFile.File {
-			if file.Name == path {
-				r, err := file.Open()
+// "repository.Path" is the Artifactory repository path to the artifact we're retrieving,
+// eg. "jar-releases/com/mycompany/external/protos/mycompany-protos" or "mycompany-public/com/mycompany/protos/all-protos",
+// or its Maven coordinates, eg. "jar-releases/com.mycompany:protos:1.0:protos".
+// "credentials" are used to authenticate to each host, as an API key unless a username is provided.
+func ArtifactoryJAR(artifactoryURL, jarURL string, repository ArtifactoryRepositoryConfig, credentials []CredentialConfig) Resolver {
+	return ArtifactoryJARs(artifactoryURL, jarURL, []ArtifactoryRepositoryConfig{repository}, credentials)
+}
+
+// ArtifactoryJARs resolves protobufs from the JAR files of several Artifactory repositories, as
+// ArtifactoryJAR does.
+//
+// Imports are looked up in a single index of the protos in every repository's JAR, preferring
+// repositories in the order they are configured, so JARs that don't provide an import are never read.
+func ArtifactoryJARs(artifactoryURL, jarURL string, repositories []ArtifactoryRepositoryConfig, credentials []CredentialConfig) Resolver {
+	client := &mavenClient{creds: newCredentialStore(credentials), apiKeyEnv: "ARTIFACTORY_API_KEY"}
+	if u, err := url.Parse(artifactoryURL); err == nil {
+		client.apiKeyHost = u.Host
+	}
+	var lock sync.Mutex
+	var index archiveIndex
+	return func(ctx context.Context, path string) (NamedReadCloser, error) {
+		lock.Lock()
+		if index == nil {
+			opened := archiveIndex{}
+			for _, repository := range repositories {
+				archive, err := openJAR(ctx, client, artifactoryURL, jarURL, repository)
 				if err != nil {
-					return nil, errors.Wrap(err, jarPath)
+					lock.Unlock()
+					return nil, errors.Wrap(err, jarURL)
 				}
-				return &namedReadCloser{name: jarPath + "#" + path, ReadCloser: r}, nil
+				opened.add(archive, repository.StripPrefix, Origin{Resolver: "artifactory", Source: repository.Path, Version: archive.version.file})
 			}
+			index = opened
 		}
+		lock.Unlock()
+		return index.open(ctx, path)
+	}
+}
+
+// Open the file name within the archive as imp, returning (nil, nil) if it is not present.
+func (a *openArchive) open(ctx context.Context, name, imp string, origin Origin) (NamedReadCloser, error) {
+	if _, err := a.reader(ctx); err != nil {
+		return nil, err
+	}
+	file, ok := a.files[name]
+	if !ok {
 		return nil, nil
 	}
+	r, err := file.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, a.path)
+	}
+	return &namedReadCloser{
+		name:       a.path + "#" + imp,
+		origin:     origin,
+		ReadCloser: r,
+	}, nil
 }
 
-// Download and cache latest version of a JAR file.
-func openJAR(artifactoryURL, jarBaseURL string, repository ArtifactoryRepositoryConfig) (string, *zip.ReadCloser, error) {
-	cacheDir, err := os.UserCacheDir()
+// An openArchive is a downloaded artifact and its index of protos.
+//
+// The archive itself is only opened, and if necessary downloaded again, once a proto is read from it.
+type openArchive struct {
+	// Path of the archive on disk.
+	path string
+	// Path of the archive's index of protos.
+	indexPath string
+	artifact  artifact
+	version   artifactVersion
+	// Protos in the archive, sorted by name.
+	protos []string
+	load   func(ctx context.Context) (*zip.ReadCloser, error)
+
+	lock sync.Mutex
+	zip  *zip.ReadCloser
+	// Files in the archive by name, once it is open.
+	files map[string]*zip.File
+}
+
+// Return the reader of the archive, opening it on first use.
+func (a *openArchive) reader(ctx context.Context) (*zip.ReadCloser, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.zip != nil {
+		return a.zip, nil
+	}
+	zr, err := a.load(ctx)
 	if err != nil {
-		return "", nil, errors.WithStack(err)
+		return nil, err
+	}
+	a.files = make(map[string]*zip.File, len(zr.File))
+	for _, file := range zr.File {
+		a.files[file.Name] = file
 	}
+	a.zip = zr
+	return zr, nil
+}
 
-	artifactName := filepath.Base(repository.Path)
-	version := repository.Version
-	if version == "" {
-		version, err = syncJARMetadata(artifactoryURL, repository.Path)
+// Resolve the version of a JAR file and read its index, downloading and caching it if necessary.
+//
+// Artifacts in local repositories are opened in place, rather than being cached.
+func openJAR(ctx context.Context, client *mavenClient, artifactoryURL, jarBaseURL string, repository ArtifactoryRepositoryConfig) (*openArchive, error) {
+	artifact, err := repository.artifact()
+	if err != nil {
+		return nil, err
+	}
+	local := strings.HasPrefix(jarBaseURL, "file://")
+	var version artifactVersion
+	if isExactVersion(artifact.version) {
+		version = exactVersion(artifact.version)
+	} else {
+		if IsOffline(ctx) && !local {
+			return nil, errors.Errorf("%s: version %q is not pinned, so can not be resolved offline", repository.Path, artifact.version)
+		}
+		version, err = resolveArtifactVersion(ctx, client, artifactoryURL+"/"+artifact.path, artifact.version, artifact.classifier, artifact.extension)
 		if err != nil {
-			return "", nil, err
+			return nil, err
 		}
 	}
+	archive := &openArchive{artifact: artifact, version: version}
 
-	filename := fmt.Sprintf("%s-%s.jar", artifactName, version)
-	dest := filepath.Join(cacheDir, filename)
+	filename := artifact.filename(version.file)
+	jarPath := fmt.Sprintf("%s/%s/%s/%s", jarBaseURL, artifact.path, version.dir, filename)
+	cacheDir, err := artifactCacheDir(jarCacheKind, jarBaseURL+"/"+artifact.path)
+	if err != nil {
+		return nil, err
+	}
+	if local {
+		archive.path = filepath.FromSlash(strings.TrimPrefix(jarPath, "file://"))
+		archive.indexPath = filepath.Join(cacheDir, filename+indexSuffix)
+		archive.load = func(context.Context) (*zip.ReadCloser, error) {
+			zr, err := zip.OpenReader(archive.path)
+			return zr, errors.WithStack(err)
+		}
+		return archive, archive.readIndex(ctx)
+	}
+	archive.path = filepath.Join(cacheDir, filename)
+	archive.indexPath = archive.path + indexSuffix
+	if !IsOffline(ctx) {
+		migrateLegacyJAR(ctx, client, jarPath, archive.path)
+	}
+	// Record use of the JAR, and of its index so that it is never older than the JAR.
+	touch(archive.path)
+	touch(archive.indexPath)
+	archive.load = func(ctx context.Context) (*zip.ReadCloser, error) {
+		return loadJAR(ctx, client, jarPath, archive.path, repository.Path, version)
+	}
+	return archive, archive.readIndex(ctx)
+}
+
+// Open a cached JAR, downloading it if it is not cached or is corrupt.
+func loadJAR(ctx context.Context, client *mavenClient, jarPath, dest, name string, version artifactVersion) (*zip.ReadCloser, error) {
 	if _, err := os.Stat(dest); err == nil {
-		zr, err := zip.OpenReader(dest)
-		return dest, zr, errors.WithStack(err)
+		zr, err := openCachedJAR(dest)
+		if err == nil {
+			return zr, nil
+		}
+		if IsOffline(ctx) {
+			return nil, errors.Wrap(err, "cached JAR is corrupt, and can not be downloaded again offline")
+		}
+		log.Warnf("Downloading %s again, as the cached JAR is corrupt: %s", name, err)
+		for _, suffix := range jarSidecarSuffixes {
+			_ = os.Remove(dest + suffix)
+		}
+		_ = os.Remove(dest)
+	}
+	if IsOffline(ctx) {
+		return nil, errors.Errorf("%s: version %s is not cached, and can not be downloaded offline", name, version.file)
 	}
+	if err := downloadJAR(ctx, client, jarPath, dest); err != nil {
+		return nil, err
+	}
+	zr, err := zip.OpenReader(dest)
+	return zr, errors.WithStack(err)
+}
 
-	// Download the JAR file into the user's cache directory.
-	jarPath := fmt.Sprintf("%s/%s/%s/%s", jarBaseURL, repository.Path, version, filename)
-	log.Debugf("Syncing %s version %s", repository.Path, version)
-	req, err := http.NewRequest(http.MethodGet, jarPath, nil)
+// Open a cached JAR, verifying it against its recorded checksum.
+func openCachedJAR(path string) (*zip.ReadCloser, error) {
+	if err := verifyCachedChecksum(path); err != nil {
+		return nil, err
+	}
+	zr, err := zip.OpenReader(path)
+	return zr, errors.Wrap(err, path)
+}
+
+// Download a JAR into the user's cache directory, verifying it against the checksum published
+// alongside it before moving it into place.
+func downloadJAR(ctx context.Context, client *mavenClient, jarPath, dest string) error {
+	log.Debugf("Syncing %s", jarPath)
+	expected, err := fetchChecksum(ctx, client, jarPath)
 	if err != nil {
-		return "", nil, errors.Wrap(err, jarPath)
+		return err
+	}
+	if expected == nil {
+		log.Warnf("%s: no checksum is published, so it can not be verified", jarPath)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.get(ctx, jarPath)
 	if err != nil {
-		return "", nil, errors.Wrap(err, jarPath)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return "", nil, errors.Errorf("%d: %s", resp.StatusCode, resp.Status)
+		return errors.Errorf("%d: %s", resp.StatusCode, resp.Status)
 	}
 
-	log.Debugf("  <- %s (%s)", jarPath, humanSize(resp.ContentLength))
+	log.Debugf("  <- %s (%s)", jarPath, FormatSize(resp.ContentLength))
 	log.Debugf("  -> %s", dest)
-	w, err := ioutil.TempFile(cacheDir, artifactName+"-*.jar")
+	ext := filepath.Ext(dest)
+	w, err := ioutil.TempFile(filepath.Dir(dest), strings.TrimSuffix(filepath.Base(dest), ext)+"-*"+ext)
 	if err != nil {
-		return "", nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
+	defer os.Remove(w.Name()) // Fails harmlessly once renamed into place.
 	defer w.Close()
 
-	_, err = io.Copy(w, resp.Body)
+	sha := sha256.New()
+	writers := []io.Writer{w, sha}
+	verify := sha
+	if expected != nil && expected.algorithm != "sha256" {
+		verify = expected.newHash()
+		writers = append(writers, verify)
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), resp.Body)
 	if err != nil {
-		return "", nil, errors.WithStack(err)
+		return errors.Wrap(err, jarPath)
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return errors.Errorf("%s: truncated download, expected %d bytes but got %d", jarPath, resp.ContentLength, n)
+	}
+	if expected != nil {
+		if err := expected.verify(jarPath, verify); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return errors.WithStack(err)
 	}
-	err = os.Rename(w.Name(), dest)
+	zr, err := zip.OpenReader(w.Name())
 	if err != nil {
-		return "", nil, errors.WithStack(err)
+		return errors.Wrapf(err, "%s: invalid JAR", jarPath)
 	}
-	zr, err := zip.OpenReader(dest)
-	return dest, zr, errors.WithStack(err)
+	zr.Close()
+	// Record the checksum, so the cached JAR can be verified each time it is used.
+	err = ioutil.WriteFile(dest+checksumSuffix, []byte(hex.EncodeToString(sha.Sum(nil))+"\n"), 0o600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Any index is of a previous download.
+	_ = os.Remove(dest + indexSuffix)
+	return errors.WithStack(os.Rename(w.Name(), dest))
 }
 
-// In any civilised world we'd just download the entire metadata file because it's simplest,
-// but because Square's Artifactory is so MIND NUMBINGLY slow (+20s vs. 2s in Snapifact)
-// we'll do a streaming read of the XML and abort as soon as we have the latest version.
-func syncJARMetadata(artifactoryURL, repositoryPath string) (string, error) {
-	log.Debugf("Syncing %s metadata.", repositoryPath)
-	url := fmt.Sprintf("%s/%s/maven-metadata.xml", artifactoryURL, repositoryPath)
-	resp, err := http.Get(url)
+// Returns true if version is a specific version rather than a keyword or range.
+//
+// SNAPSHOT versions are not exact, as they must be resolved to a timestamped version.
+func isExactVersion(version string) bool {
+	return version != "" && version != LatestVersion && version != ReleaseVersion &&
+		!isVersionRange(version) && !strings.HasSuffix(version, snapshotSuffix)
+}
+
+// Subdirectories of the cache directory that JARs and POMs are cached in.
+const (
+	jarCacheKind = "jars"
+	pomCacheKind = "poms"
+)
+
+// Directory artifacts of a kind are cached in, created if necessary.
+//
+// Each artifact has its own directory, keyed by its URL in the repository, eg.
+// "https://repo.example.com/maven2/com/mycompany/protos", which is recorded in the directory.
+func artifactCacheDir(kind, artifactURL string) (string, error) {
+	cacheDir, err := CacheDir()
 	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cacheDir, kind, path.Base(artifactURL)+"-"+hash(artifactURL))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
 		return "", errors.WithStack(err)
 	}
-	log.Debugf("  <- %s (%s)", url, humanSize(resp.ContentLength))
-	defer resp.Body.Close()
-	dec := xml.NewDecoder(resp.Body)
-	for {
-		// Read tokens from the XML document in a stream.
-		t, err := dec.Token()
-		if err != nil {
+	source := filepath.Join(dir, sourceFile)
+	if _, err := os.Stat(source); err != nil {
+		if err := ioutil.WriteFile(source, []byte(artifactURL), 0o600); err != nil {
 			return "", errors.WithStack(err)
 		}
-		if t == nil {
-			break
-		}
-		if se, ok := t.(xml.StartElement); ok {
-			if se.Name.Local == "latest" {
-				var version string
-				return version, errors.WithStack(dec.DecodeElement(&version, &se))
-			}
-		}
 	}
-	return "", errors.Errorf("could not find latest version")
+	return dir, nil
 }
 
-// nolint: gomnd
-func humanSize(n int64) string {
-	switch {
-	case n < 1024:
-		return fmt.Sprintf("%dB", n)
-	case n < 1024*1024:
-		return fmt.Sprintf("%dKiB", n/1024)
-	default:
-		return fmt.Sprintf("%dMiB", n/1024/1024)
+// Directory JARs used to be cached in, which tests override.
+var legacyJARDir = os.UserCacheDir
+
+// JARs used to be cached directly in the user's cache directory, keyed only by filename, so move one
+// into place if present and it matches the checksum published for jarPath. Otherwise it may be another
+// artifact with the same filename, or not protosync's at all, so it is left alone.
+func migrateLegacyJAR(ctx context.Context, client *mavenClient, jarPath, dest string) {
+	cacheDir, err := legacyJARDir()
+	if err != nil {
+		return
+	}
+	legacy := filepath.Join(cacheDir, path.Base(jarPath))
+	if _, err := os.Stat(legacy); err != nil {
+		return
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return
+	}
+	expected, err := fetchChecksum(ctx, client, jarPath)
+	if err != nil || expected == nil {
+		return
+	}
+	f, err := os.Open(legacy)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sha := sha256.New()
+	verify := expected.newHash()
+	if _, err := io.Copy(io.MultiWriter(sha, verify), f); err != nil || expected.verify(legacy, verify) != nil {
+		return
+	}
+	err = ioutil.WriteFile(dest+checksumSuffix, []byte(hex.EncodeToString(sha.Sum(nil))+"\n"), 0o600)
+	if err != nil {
+		return
+	}
+	if err := os.Rename(legacy, dest); err != nil {
+		_ = os.Remove(dest + checksumSuffix)
+		return
 	}
+	log.Debugf("Moved %s to %s", legacy, dest)
 }
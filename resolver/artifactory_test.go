@@ -0,0 +1,234 @@
+package resolver // nolint: testpackage
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactCoordinates(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		repository ArtifactoryRepositoryConfig
+		expected   artifact
+		err        string
+	}{
+		{repository: ArtifactoryRepositoryConfig{Path: "jar-releases/com/mycompany/protos"},
+			expected: artifact{path: "jar-releases/com/mycompany/protos", extension: "jar"}},
+		{repository: ArtifactoryRepositoryConfig{Path: "jar-releases/com.mycompany:protos:1.0:protos"},
+			expected: artifact{path: "jar-releases/com/mycompany/protos", version: "1.0", classifier: "protos", extension: "jar"}},
+		{repository: ArtifactoryRepositoryConfig{Path: "com.mycompany:protos", Version: "release", Extension: "zip"},
+			expected: artifact{path: "com/mycompany/protos", version: "release", extension: "zip"}},
+		{repository: ArtifactoryRepositoryConfig{Path: "com.mycompany:protos:1.0", Version: "2.0"},
+			expected: artifact{path: "com/mycompany/protos", version: "2.0", extension: "jar"}},
+		{repository: ArtifactoryRepositoryConfig{Path: "com.mycompany"},
+			expected: artifact{path: "com.mycompany", extension: "jar"}},
+		{repository: ArtifactoryRepositoryConfig{Path: "com.mycompany:"},
+			err: "com.mycompany:: invalid Maven coordinates, expected group:artifact:version[:classifier]"},
+		{repository: ArtifactoryRepositoryConfig{Path: "com/mycompany/protos", Extension: "tar"},
+			err: `com/mycompany/protos: unsupported extension "tar", must be jar or zip`},
+	}
+	for _, test := range tests {
+		actual, err := test.repository.artifact()
+		if test.err != "" {
+			require.EqualError(t, err, test.err)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, test.expected, actual)
+		}
+	}
+}
+
+func TestArtifactoryClassifier(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	jar := buildJAR(t, map[string]string{"src/main/proto/a.proto": `syntax = "proto3";`})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repo/com/mycompany/protos/1.0/protos-1.0-protos.zip" {
+			_, _ = w.Write(jar)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	resolve := ArtifactoryJAR(srv.URL, srv.URL, ArtifactoryRepositoryConfig{
+		Path:        "repo/com.mycompany:protos:1.0:protos",
+		Extension:   "zip",
+		StripPrefix: "src/main/proto",
+	}, nil)
+	r, err := resolve(context.Background(), "a.proto")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, `syntax = "proto3";`, string(data))
+	require.Equal(t, Origin{Resolver: "artifactory", Source: "repo/com.mycompany:protos:1.0:protos", Version: "1.0"}, OriginOf(r))
+
+	// The protos in the archive are indexed next to it.
+	entries, err := ListCache()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.FileExists(t, entries[0].Path+indexSuffix)
+	protos, err := entries[0].Protos()
+	require.NoError(t, err)
+	require.Equal(t, []string{"src/main/proto/a.proto"}, protos)
+	require.NoError(t, entries[0].Remove(context.Background()))
+	require.NoFileExists(t, entries[0].Path+indexSuffix)
+}
+
+func TestArtifactoryIndex(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	jars := map[string][]byte{
+		"/repo/com/acme/a/1.0/a-1.0.jar": buildJAR(t, map[string]string{"a.proto": "a", "c.proto": "a"}),
+		"/repo/com/acme/b/1.0/b-1.0.jar": buildJAR(t, map[string]string{"b.proto": "b", "c.proto": "b"}),
+	}
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if jar, ok := jars[r.URL.Path]; ok {
+			downloads++
+			_, _ = w.Write(jar)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	repositories := []ArtifactoryRepositoryConfig{{Path: "repo/com.acme:a:1.0"}, {Path: "repo/com.acme:b:1.0"}}
+	ctx := context.Background()
+	read := func(resolve Resolver, path string) string {
+		r, err := resolve(ctx, path)
+		require.NoError(t, err)
+		require.NotNil(t, r, path)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// Repositories are preferred in the order they are configured.
+	resolve := ArtifactoryJARs(srv.URL, srv.URL, repositories, nil)
+	require.Equal(t, "a", read(resolve, "c.proto"))
+	require.Equal(t, "b", read(resolve, "b.proto"))
+	r, err := resolve(ctx, "missing.proto")
+	require.NoError(t, err)
+	require.Nil(t, r)
+	require.Equal(t, 2, downloads)
+
+	// Once indexed, a JAR that does not provide an import is not read, so it is not verified either.
+	entries, err := ListCache()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "a-1.0.jar", filepath.Base(entries[0].Path))
+	require.NoError(t, ioutil.WriteFile(entries[0].Path, []byte("corrupt"), 0o600))
+	resolve = ArtifactoryJARs(srv.URL, srv.URL, repositories, nil)
+	require.Equal(t, "b", read(resolve, "b.proto"))
+	require.Equal(t, 2, downloads)
+}
+
+// Build a JAR containing files, keyed by name.
+func buildJAR(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestArtifactCacheKeyedByURL(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	jars := map[string][]byte{
+		"/com/a/protos/1.0/protos-1.0.jar": buildJAR(t, map[string]string{"a.proto": "a"}),
+		"/com/b/protos/1.0/protos-1.0.jar": buildJAR(t, map[string]string{"b.proto": "b"}),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if jar, ok := jars[r.URL.Path]; ok {
+			_, _ = w.Write(jar)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	// Artifacts with the same filename from different groups must not share a cache entry.
+	for _, test := range []struct{ coordinates, proto string }{
+		{"com.a:protos:1.0", "a.proto"},
+		{"com.b:protos:1.0", "b.proto"},
+		{"com.a:protos:1.0", "a.proto"},
+	} {
+		resolve := Maven(MavenConfig{URL: srv.URL, Artifacts: []MavenArtifactConfig{{Path: test.coordinates}}})
+		r, err := resolve(ctx, test.proto)
+		require.NoError(t, err)
+		require.NotNil(t, r, test.coordinates)
+		require.NoError(t, r.Close())
+	}
+	entries, err := ListCache()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestMigrateLegacyJAR(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	cache := t.TempDir()
+	legacyJARDir = func() (string, error) { return cache, nil }
+	t.Cleanup(func() { legacyJARDir = os.UserCacheDir })
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	jars := map[string][]byte{
+		"/com/a/protos/1.0/protos-1.0.jar": buildJAR(t, map[string]string{"a.proto": "a"}),
+		"/com/b/protos/1.0/protos-1.0.jar": buildJAR(t, map[string]string{"b.proto": "b"}),
+	}
+	downloads := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if jar, ok := jars[strings.TrimSuffix(r.URL.Path, ".sha256")]; ok {
+			if strings.HasSuffix(r.URL.Path, ".sha256") {
+				sum := sha256.Sum256(jar)
+				_, _ = w.Write([]byte(hex.EncodeToString(sum[:])))
+				return
+			}
+			downloads[r.URL.Path]++
+			_, _ = w.Write(jar)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	legacy := filepath.Join(cache, "protos-1.0.jar")
+	require.NoError(t, ioutil.WriteFile(legacy, jars["/com/a/protos/1.0/protos-1.0.jar"], 0o600))
+	ctx := context.Background()
+
+	// A legacy JAR with the same filename as another artifact is not adopted by it.
+	r, err := Maven(MavenConfig{URL: srv.URL, Artifacts: []MavenArtifactConfig{{Path: "com.b:protos:1.0"}}})(ctx, "b.proto")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	require.NoError(t, r.Close())
+	require.Equal(t, 1, downloads["/com/b/protos/1.0/protos-1.0.jar"])
+	require.FileExists(t, legacy)
+
+	// It is moved into place for the artifact whose published checksum it matches.
+	r, err = Maven(MavenConfig{URL: srv.URL, Artifacts: []MavenArtifactConfig{{Path: "com.a:protos:1.0"}}})(ctx, "a.proto")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	require.NoError(t, r.Close())
+	require.Equal(t, 0, downloads["/com/a/protos/1.0/protos-1.0.jar"])
+	require.NoFileExists(t, legacy)
+}
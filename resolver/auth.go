@@ -0,0 +1,203 @@
+package resolver
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/log"
+)
+
+// CredentialConfig defines where to find the credentials for a host.
+//
+// If neither "token-env" nor "token-file" is set, the fetcher's default environment variable
+// (eg. $GITHUB_TOKEN) is used, falling back to ~/.netrc (or $NETRC).
+type CredentialConfig struct {
+	Host      string `hcl:"host,label" help:"Hostname the credentials apply to."`
+	Username  string `hcl:"username,optional" help:"Username to authenticate as, if the host requires one."`
+	TokenEnv  string `hcl:"token-env,optional" help:"Environment variable containing the token or password."`
+	TokenFile string `hcl:"token-file,optional" help:"File containing the token or password."`
+}
+
+// A credential for a single host.
+type credential struct {
+	username string
+	secret   string
+}
+
+// String deliberately does not include the secret, so that credentials cannot be logged by accident.
+func (c *credential) String() string {
+	if c.username == "" {
+		return "token:<redacted>"
+	}
+	return c.username + ":<redacted>"
+}
+
+// Set HTTP basic auth, or a bearer token if there is no username.
+//
+// Nothing is set if there is no secret, as an empty token is never valid.
+func (c *credential) basicOrBearer(header http.Header) {
+	switch {
+	case c.secret == "":
+	case c.username != "":
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.secret)))
+	default:
+		header.Set("Authorization", "Bearer "+c.secret)
+	}
+}
+
+// Follow redirects like http.Client does by default, but drop every header set on the original
+// request when redirected to another host.
+//
+// http.Client only drops Authorization and Cookie itself, while credentials may also be sent as
+// custom headers such as X-JFrog-Art-Api or PRIVATE-TOKEN, or as configured host headers, and
+// Artifactory commonly redirects downloads to third party storage.
+func stripHeadersOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header = http.Header{}
+	}
+	return nil
+}
+
+// credentialStore looks up credentials for hosts.
+type credentialStore struct {
+	configs   []CredentialConfig
+	netrcOnce sync.Once
+	netrc     map[string]*credential
+}
+
+func newCredentialStore(configs []CredentialConfig) *credentialStore {
+	return &credentialStore{configs: configs}
+}
+
+// Lookup the credential for host, returning nil if there is none.
+//
+// Explicit configuration takes precedence, then the environment variable "env" if provided, then netrc.
+// A nil store has no credentials.
+func (c *credentialStore) lookup(host, env string) (*credential, error) {
+	if c == nil {
+		return nil, nil
+	}
+	host = strings.Split(host, ":")[0]
+	username := ""
+	for _, config := range c.configs {
+		if config.Host != host {
+			continue
+		}
+		username = config.Username
+		switch {
+		case config.TokenEnv != "":
+			secret := os.Getenv(config.TokenEnv)
+			if secret == "" {
+				return nil, errors.Errorf("%s: credentials environment variable $%s is not set", host, config.TokenEnv)
+			}
+			return &credential{username: username, secret: secret}, nil
+		case config.TokenFile != "":
+			data, err := ioutil.ReadFile(expandHome(config.TokenFile))
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: could not read credentials", host)
+			}
+			return &credential{username: username, secret: strings.TrimSpace(string(data))}, nil
+		}
+	}
+	if env != "" {
+		if secret := os.Getenv(env); secret != "" {
+			return &credential{username: username, secret: secret}, nil
+		}
+	}
+	c.netrcOnce.Do(func() {
+		var err error
+		c.netrc, err = loadNetrc()
+		if err != nil {
+			log.Warnf("could not load netrc, ignoring: %s", err)
+		}
+	})
+	return c.netrc[host], nil
+}
+
+// Load credentials from $NETRC or ~/.netrc, keyed by machine.
+//
+// The "default" entry is ignored, so that credentials are only ever sent to hosts they were configured for.
+func loadNetrc() (map[string]*credential, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return parseNetrc(string(data)), nil
+}
+
+func parseNetrc(data string) map[string]*credential {
+	creds := map[string]*credential{}
+	machines := []string{}
+	entries := []*credential{}
+	var current *credential
+	tokens := strings.Fields(data)
+tokens:
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			current = &credential{}
+			machines = append(machines, next())
+			entries = append(entries, current)
+		case "default":
+			current = nil
+		case "login":
+			login := next()
+			if current != nil {
+				current.username = login
+			}
+		case "password":
+			password := next()
+			if current != nil {
+				current.secret = password
+			}
+		case "macdef":
+			// Macros run until the end of the file as far as we're concerned.
+			break tokens
+		}
+	}
+	// The first entry for a machine wins, but an entry without a password is no credential at all.
+	for i, machine := range machines {
+		if _, ok := creds[machine]; !ok && entries[i].secret != "" {
+			creds[machine] = entries[i]
+		}
+	}
+	return creds
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
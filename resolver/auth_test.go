@@ -0,0 +1,150 @@
+package resolver // nolint: testpackage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialLookup(t *testing.T) {
+	dir := t.TempDir()
+	netrc := filepath.Join(dir, "netrc")
+	err := ioutil.WriteFile(netrc, []byte(`
+machine git.example.com login alice password netrc-secret
+machine github.com
+  password github-netrc
+machine nopassword.example.com login carol
+machine gitlab.example.com login dave
+machine gitlab.example.com login erin password gitlab-netrc
+default login anonymous password guest
+`), 0o600)
+	require.NoError(t, err)
+	tokenFile := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenFile, []byte("file-secret\n"), 0o600)
+	require.NoError(t, err)
+	t.Setenv("NETRC", netrc)
+	t.Setenv("GITHUB_TOKEN", "env-secret")
+	t.Setenv("MY_TOKEN", "configured-secret")
+
+	creds := newCredentialStore([]CredentialConfig{
+		{Host: "bitbucket.example.com", Username: "bob", TokenEnv: "MY_TOKEN"},
+		{Host: "artifactory.example.com", TokenFile: tokenFile},
+		{Host: "missing.example.com", TokenEnv: "MISSING_TOKEN"},
+	})
+	tests := []struct {
+		host     string
+		env      string
+		expected *credential
+	}{
+		{"bitbucket.example.com", "BITBUCKET_TOKEN", &credential{username: "bob", secret: "configured-secret"}},
+		{"artifactory.example.com:443", "", &credential{secret: "file-secret"}},
+		{"github.com", "GITHUB_TOKEN", &credential{secret: "env-secret"}},
+		{"github.com", "", &credential{secret: "github-netrc"}},
+		{"git.example.com", "", &credential{username: "alice", secret: "netrc-secret"}},
+		{"other.example.com", "", nil},
+		{"nopassword.example.com", "", nil},
+		{"gitlab.example.com", "", &credential{username: "erin", secret: "gitlab-netrc"}},
+	}
+	for _, test := range tests {
+		cred, err := creds.lookup(test.host, test.env)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, cred, test.host)
+	}
+
+	_, err = creds.lookup("missing.example.com", "")
+	require.EqualError(t, err, "missing.example.com: credentials environment variable $MISSING_TOKEN is not set")
+
+	cred, err := creds.lookup("bitbucket.example.com", "")
+	require.NoError(t, err)
+	require.NotContains(t, cred.String(), "configured-secret")
+
+	// An empty secret is never sent.
+	header := http.Header{}
+	(&credential{username: "carol"}).basicOrBearer(header)
+	(&credential{}).basicOrBearer(header)
+	require.Empty(t, header)
+}
+
+func TestArtifactoryAPIKey(t *testing.T) {
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	t.Setenv("ARTIFACTORY_API_KEY", "secret")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-JFrog-Art-Api") != "secret" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("<metadata><versioning><latest>1.2.3</latest></versioning></metadata>"))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	client := &mavenClient{creds: newCredentialStore(nil), apiKeyEnv: "ARTIFACTORY_API_KEY", apiKeyHost: u.Host}
+	version, err := resolveArtifactVersion(context.Background(), client, srv.URL+"/repo/artifact", LatestVersion, "", "jar")
+	require.NoError(t, err)
+	require.Equal(t, exactVersion("1.2.3"), version)
+
+	// The key is not sent to other hosts, such as a download mirror.
+	client.apiKeyHost = "artifactory.example.com"
+	_, err = resolveArtifactVersion(context.Background(), client, srv.URL+"/repo/artifact", LatestVersion, "", "jar")
+	require.EqualError(t, err, srv.URL+"/repo/artifact/maven-metadata.xml: 401 Unauthorized")
+}
+
+func TestCredentialsNotSentOnRedirect(t *testing.T) {
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	t.Setenv("ARTIFACTORY_API_KEY", "api-key")
+	t.Setenv("GITLAB_TOKEN", "gitlab-token")
+	var received http.Header
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		_, _ = w.Write([]byte(`syntax = "proto3";`))
+	}))
+	defer storage.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, storage.URL+"/signed", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	artifactoryURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	client := &mavenClient{creds: newCredentialStore(nil), apiKeyEnv: "ARTIFACTORY_API_KEY", apiKeyHost: artifactoryURL.Host}
+	resp, err := client.get(context.Background(), srv.URL+"/repo/a.jar")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Empty(t, received.Get("X-JFrog-Art-Api"))
+
+	u, err := url.Parse(srv.URL + "/group/repo.git")
+	require.NoError(t, err)
+	creds := newCredentialStore([]CredentialConfig{{Host: u.Hostname(), TokenEnv: "GITLAB_TOKEN"}})
+	r, err := gitLabFetcher(context.Background(), u, "a.proto", "main", creds)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Empty(t, received.Get("PRIVATE-TOKEN"))
+	require.Empty(t, received.Get("Authorization"))
+
+	fetch := templateFetcher(srv.URL+"/{project}/{commit}/{path}", map[string]string{"X-Secret": "configured"})
+	r, err = fetch(context.Background(), u, "a.proto", "main", creds)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Empty(t, received.Get("X-Secret"))
+
+	// Headers are kept when redirected within the same host.
+	var sameHost http.Header
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/same-host" {
+			http.Redirect(w, r, "/target", http.StatusFound)
+			return
+		}
+		sameHost = r.Header.Clone()
+	})
+	resp, err = client.get(context.Background(), srv.URL+"/same-host")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "api-key", sameHost.Get("X-JFrog-Art-Api"))
+}
@@ -0,0 +1,369 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type offlineKey struct{}
+
+// WithOffline returns a context in which resolvers must not access the network.
+//
+// Remote files and JARs are then served exclusively from the cache, and resolution fails if they
+// are not cached.
+func WithOffline(ctx context.Context) context.Context {
+	return context.WithValue(ctx, offlineKey{}, true)
+}
+
+// IsOffline returns true if ctx was created by WithOffline.
+func IsOffline(ctx context.Context) bool {
+	offline, _ := ctx.Value(offlineKey{}).(bool)
+	return offline
+}
+
+// CacheDirEnv is the environment variable that overrides the directory protosync caches in.
+const CacheDirEnv = "PROTOSYNC_CACHE_DIR"
+
+// CacheDir returns the directory protosync caches clones, files and JARs in.
+//
+// This is $PROTOSYNC_CACHE_DIR if set, otherwise "protosync" in the user's cache directory.
+func CacheDir() (string, error) {
+	if dir := os.Getenv(CacheDirEnv); dir != "" {
+		return dir, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filepath.Join(cacheDir, "protosync"), nil
+}
+
+// CacheEntryKind is the kind of a CacheEntry.
+type CacheEntryKind string
+
+// Kinds of cache entry.
+const (
+	// CachedClone is a git clone of a repository, used when files can not be fetched directly.
+	CachedClone CacheEntryKind = "clone"
+	// CachedFiles are the files fetched from a repository at a single commit.
+	CachedFiles CacheEntryKind = "files"
+	// CachedJAR is a JAR downloaded from Artifactory or a Maven repository, or the index of a JAR in
+	// a local repository.
+	CachedJAR CacheEntryKind = "jar"
+	// CachedPOM is a POM downloaded from a Maven repository to resolve dependencies.
+	CachedPOM CacheEntryKind = "pom"
+)
+
+// A CacheEntry is a clone, set of files or JAR in the cache.
+type CacheEntry struct {
+	Kind CacheEntryKind
+	// Path of the entry on disk. Only the index of a JAR in a local repository is cached, so its
+	// Path does not exist.
+	Path string
+	// Source is the repository URL, or the URL of a JAR or POM's artifact.
+	Source string
+	// Version is the commit of cached files, or the version (and classifier) of a JAR or POM, if known.
+	Version string
+	// Size of the entry in bytes.
+	Size int64
+	// Modified is the time the entry was last modified or, for files and JARs, used.
+	Modified time.Time
+}
+
+// FormatSize formats a size in bytes for display, eg. "1.5MiB".
+//
+// nolint: gomnd
+func FormatSize(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1fKiB", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.1fMiB", float64(n)/1024/1024)
+	default:
+		return fmt.Sprintf("%.1fGiB", float64(n)/1024/1024/1024)
+	}
+}
+
+// ListCache returns every entry in the cache, ordered by path.
+func ListCache() ([]CacheEntry, error) {
+	cacheDir, err := CacheDir()
+	if err != nil {
+		return nil, err
+	}
+	entries := []CacheEntry{}
+	dirs, err := os.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(cacheDir, dir.Name())
+		switch {
+		case dir.Name() == "files":
+			files, err := listCachedFiles(path)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, files...)
+		case dir.Name() == jarCacheKind:
+			jars, err := listCachedArtifacts(CachedJAR, path)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, jars...)
+		case dir.Name() == pomCacheKind:
+			poms, err := listCachedArtifacts(CachedPOM, path)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, poms...)
+		case dir.IsDir():
+			entry, err := newCacheEntry(CachedClone, path, cloneOrigin(path), "")
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// Remove the entry from the cache.
+//
+// A clone is removed while holding its lock, so it is not removed while another process is using it.
+// The lock file itself is kept, so that every process locks the same file.
+func (c CacheEntry) Remove(ctx context.Context) error {
+	if c.Kind == CachedJAR {
+		for _, suffix := range jarSidecarSuffixes {
+			if err := os.Remove(c.Path + suffix); err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	if c.Kind == CachedClone {
+		unlock, err := lockFile(ctx, c.Path+".lock")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := os.RemoveAll(c.Path); err != nil {
+		return errors.WithStack(err)
+	}
+	if c.Kind == CachedJAR || c.Kind == CachedPOM {
+		// Remove the artifact's directory once it contains nothing but its source.
+		dir := filepath.Dir(c.Path)
+		if files, err := os.ReadDir(dir); err == nil && len(files) == 1 && files[0].Name() == sourceFile {
+			return errors.WithStack(os.RemoveAll(dir))
+		}
+	}
+	return nil
+}
+
+// Protos returns the .proto files in a cached JAR, or nil for other entries.
+func (c CacheEntry) Protos() ([]string, error) {
+	if c.Kind != CachedJAR {
+		return nil, nil
+	}
+	return readArchiveIndex(c.Path)
+}
+
+// List files/<repo>/<commit> directories.
+func listCachedFiles(dir string) ([]CacheEntry, error) {
+	entries := []CacheEntry{}
+	repos, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, repo := range repos {
+		if !repo.IsDir() {
+			continue
+		}
+		repoDir := filepath.Join(dir, repo.Name())
+		source, _ := ioutil.ReadFile(filepath.Join(repoDir, sourceFile))
+		commits, err := os.ReadDir(repoDir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, commit := range commits {
+			if !commit.IsDir() {
+				continue
+			}
+			entry, err := newCacheEntry(CachedFiles, filepath.Join(repoDir, commit.Name()), string(source), commit.Name())
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// List JARs or POMs in <kind>/<artifact> directories.
+func listCachedArtifacts(kind CacheEntryKind, dir string) ([]CacheEntry, error) {
+	entries := []CacheEntry{}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		source, _ := ioutil.ReadFile(filepath.Join(path, sourceFile))
+		artifacts, err := os.ReadDir(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, artifact := range artifacts {
+			name := artifact.Name()
+			entryPath := filepath.Join(path, name)
+			// A JAR in a local repository is not cached, but its index is.
+			if local := strings.TrimSuffix(name, indexSuffix); kind == CachedJAR && local != name && isArchive(local) {
+				if _, err := os.Stat(filepath.Join(path, local)); os.IsNotExist(err) {
+					name = local
+				}
+			}
+			if artifact.IsDir() || (kind == CachedJAR && !isArchive(name)) || (kind == CachedPOM && filepath.Ext(name) != ".pom") {
+				continue
+			}
+			version := strings.TrimSuffix(strings.TrimPrefix(name, filepath.Base(string(source))+"-"), filepath.Ext(name))
+			entry, err := newCacheEntry(kind, entryPath, string(source), version)
+			if err != nil {
+				return nil, err
+			}
+			entry.Path = filepath.Join(path, name)
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func isArchive(name string) bool {
+	return filepath.Ext(name) == ".jar" || filepath.Ext(name) == ".zip"
+}
+
+// Create a CacheEntry, summing the size and finding the newest modification time of everything under path.
+func newCacheEntry(kind CacheEntryKind, path, source, version string) (CacheEntry, error) {
+	entry := CacheEntry{Kind: kind, Path: path, Source: source, Version: version}
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !d.IsDir() {
+			entry.Size += info.Size()
+		}
+		if info.ModTime().After(entry.Modified) {
+			entry.Modified = info.ModTime()
+		}
+		return nil
+	})
+	return entry, err
+}
+
+// Read the origin URL of a clone from its git config, returning "" if it can't be determined.
+func cloneOrigin(dir string) string {
+	f, err := os.Open(filepath.Join(dir, ".git", "config"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	inOrigin := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inOrigin = line == `[remote "origin"]`
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && inOrigin && strings.TrimSpace(key) == "url" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// Each files/<repo> directory records the repository URL in this file.
+const sourceFile = ".source"
+
+// Directory files from a repository are cached in, with a subdirectory per commit.
+func cachedRepoDir(repoURL string) (string, error) {
+	cacheDir, err := CacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "files", filepath.Base(repoURL)+"-"+hash(repoURL)), nil
+}
+
+// Record use of a cached file.
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// Open a cached file, returning (nil, nil) if it is not cached.
+func openCachedFile(repoURL, commit, relPath string) (NamedReadCloser, error) {
+	repoDir, err := cachedRepoDir(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(repoDir, commit, filepath.FromSlash(relPath))
+	r, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	touch(path)
+	return &namedReadCloser{name: path, ReadCloser: r}, nil
+}
+
+// Atomically write a file to the content cache.
+func writeCachedFile(repoURL, commit, relPath string, data []byte) error {
+	repoDir, err := cachedRepoDir(repoURL)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(repoDir, commit, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	source := filepath.Join(repoDir, sourceFile)
+	if _, err := os.Stat(source); err != nil {
+		if err := ioutil.WriteFile(source, []byte(repoURL), 0o600); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	w, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(w.Name()) // Fails harmlessly once renamed into place.
+	defer w.Close()
+	if _, err := w.Write(data); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := w.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(w.Name(), path))
+}
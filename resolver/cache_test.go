@@ -0,0 +1,94 @@
+package resolver // nolint: testpackage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListCache(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	cacheDir, err := CacheDir()
+	require.NoError(t, err)
+
+	err = writeCachedFile("https://github.com/org/repo.git", "abc", "a/b.proto", []byte("12345"))
+	require.NoError(t, err)
+	clone := filepath.Join(cacheDir, "repo.git-1234")
+	require.NoError(t, os.MkdirAll(filepath.Join(clone, ".git"), 0o700))
+	gitConfig := `[core]
+	bare = false
+[remote "origin"]
+	url = https://github.com/org/repo.git
+`
+	err = ioutil.WriteFile(filepath.Join(clone, ".git", "config"), []byte(gitConfig), 0o600)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(clone+".lock", nil, 0o600))
+	artifactURL := "https://repo.example.com/com/acme/protos"
+	jars, err := artifactCacheDir(jarCacheKind, artifactURL)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(jars, "protos-1.0.jar"), []byte("jar"), 0o600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(jars, "protos-1.0.jar"+checksumSuffix), []byte("abc\n"), 0o600))
+	poms, err := artifactCacheDir(pomCacheKind, artifactURL)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(poms, "protos-1.0.pom"), []byte("<project/>"), 0o600))
+
+	entries, err := ListCache()
+	require.NoError(t, err)
+	actual := []CacheEntry{}
+	for _, entry := range entries {
+		require.False(t, entry.Modified.IsZero())
+		entry.Modified = time.Time{}
+		actual = append(actual, entry)
+	}
+	require.Equal(t, []CacheEntry{
+		{Kind: CachedFiles, Path: filepath.Join(cacheDir, "files", "repo.git-"+hash("https://github.com/org/repo.git"), "abc"),
+			Source: "https://github.com/org/repo.git", Version: "abc", Size: 5},
+		{Kind: CachedJAR, Path: filepath.Join(jars, "protos-1.0.jar"), Source: artifactURL, Version: "1.0", Size: 3},
+		{Kind: CachedPOM, Path: filepath.Join(poms, "protos-1.0.pom"), Source: artifactURL, Version: "1.0", Size: 10},
+		{Kind: CachedClone, Path: clone, Source: "https://github.com/org/repo.git", Size: int64(len(gitConfig))},
+	}, actual)
+
+	ctx := context.Background()
+	require.NoError(t, entries[0].Remove(ctx))
+	require.NoError(t, entries[1].Remove(ctx))
+	require.NoDirExists(t, jars)
+
+	// A clone in use by another process is not removed.
+	unlock, err := lockFile(ctx, clone+".lock")
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	require.True(t, errors.Is(entries[3].Remove(timeoutCtx), context.DeadlineExceeded))
+	require.DirExists(t, clone)
+	unlock()
+
+	require.NoError(t, entries[3].Remove(ctx))
+	require.NoDirExists(t, clone)
+	require.FileExists(t, clone+".lock")
+	entries, err = ListCache()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestLockFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lock")
+	unlock, err := lockFile(context.Background(), path)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = lockFile(ctx, path)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	unlock()
+	unlock, err = lockFile(context.Background(), path)
+	require.NoError(t, err)
+	unlock()
+}
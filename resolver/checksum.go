@@ -0,0 +1,91 @@
+package resolver
+
+import (
+	"context"
+	"crypto/sha1" // nolint: gosec
+	"crypto/sha256"
+	"encoding/hex"
+	stdhash "hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Each cached JAR has a sidecar file containing its verified SHA-256 checksum.
+const checksumSuffix = ".sha256"
+
+// A published checksum for an artifact.
+type checksum struct {
+	algorithm string
+	sum       string
+	newHash   func() stdhash.Hash
+}
+
+// Checksum algorithms published alongside artifacts, in order of preference.
+var checksumAlgorithms = []checksum{
+	{algorithm: "sha256", newHash: sha256.New},
+	{algorithm: "sha1", newHash: sha1.New},
+}
+
+// Fetch the checksum Artifactory publishes alongside artifactURL, returning nil if there is none.
+func fetchChecksum(ctx context.Context, client *mavenClient, artifactURL string) (*checksum, error) {
+	for _, algorithm := range checksumAlgorithms {
+		url := artifactURL + "." + algorithm.algorithm
+		resp, err := client.get(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, errors.Errorf("%s: %s", url, resp.Status)
+		} else if err != nil {
+			return nil, errors.Wrap(err, url)
+		}
+		// Checksum files may be followed by the filename, as output by sha256sum.
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			return nil, errors.Errorf("%s: empty checksum", url)
+		}
+		algorithm.sum = strings.ToLower(fields[0])
+		return &algorithm, nil
+	}
+	return nil, nil
+}
+
+// Verify that the file at path matches the checksum recorded in its sidecar file, if any.
+func verifyCachedChecksum(path string) error {
+	expected, err := ioutil.ReadFile(path + checksumSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.Wrap(err, path)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != strings.TrimSpace(string(expected)) {
+		return errors.Errorf("%s: sha256 checksum mismatch, expected %s but got %s", path, strings.TrimSpace(string(expected)), actual)
+	}
+	return nil
+}
+
+// Verify the hash of an artifact against its published checksum.
+func (c *checksum) verify(name string, h stdhash.Hash) error {
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != c.sum {
+		return errors.Errorf("%s: %s checksum mismatch, expected %s but got %s", name, c.algorithm, c.sum, actual)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package resolver // nolint: testpackage
+
+import (
+	"context"
+	"crypto/sha1" // nolint: gosec
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJARChecksum(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	jar := buildJAR(t, map[string]string{"a.proto": `syntax = "proto3";`})
+	sum := sha1.Sum(jar) // nolint: gosec
+	checksum := hex.EncodeToString(sum[:]) + "  protos-1.0.jar"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repo/protos/1.0/protos-1.0.jar":
+			_, _ = w.Write(jar)
+		case "/repo/protos/1.0/protos-1.0.jar.sha1":
+			_, _ = w.Write([]byte(checksum))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	repository := ArtifactoryRepositoryConfig{Path: "repo/protos", Version: "1.0"}
+
+	client := &mavenClient{}
+	// Cached JARs are only verified once read.
+	open := func(ctx context.Context) (*openArchive, error) {
+		archive, err := openJAR(ctx, client, srv.URL, srv.URL, repository)
+		if err != nil {
+			return nil, err
+		}
+		_, err = archive.reader(ctx)
+		return archive, err
+	}
+	archive, err := open(ctx)
+	require.NoError(t, err)
+	require.NoError(t, archive.zip.Close())
+	path := archive.path
+	require.FileExists(t, path+checksumSuffix)
+
+	// A corrupt cached JAR is downloaded again, but not when offline.
+	require.NoError(t, ioutil.WriteFile(path, jar[:10], 0o600))
+	_, err = open(WithOffline(ctx))
+	require.Error(t, err)
+	archive, err = open(ctx)
+	require.NoError(t, err)
+	require.NoError(t, archive.zip.Close())
+
+	// A download that doesn't match its published checksum is rejected.
+	checksum = "0000000000000000000000000000000000000000"
+	require.NoError(t, ioutil.WriteFile(path, []byte("corrupt"), 0o600))
+	_, err = open(ctx)
+	require.EqualError(t, err, srv.URL+"/repo/protos/1.0/protos-1.0.jar: sha1 checksum mismatch, expected 0000000000000000000000000000000000000000 but got "+hex.EncodeToString(sum[:]))
+	require.NoFileExists(t, path)
+}
@@ -0,0 +1,43 @@
+package resolver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/log"
+)
+
+// Take an exclusive lock on the file at path, creating it if necessary.
+//
+// Blocks until the lock is acquired or ctx is cancelled.
+func lockFile(ctx context.Context, path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for logged := false; ; logged = true {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, path)
+		}
+		if ok {
+			return func() {
+				_ = unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if !logged {
+			log.Infof("Waiting for another protosync process to release %s", path)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, errors.WithStack(ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package resolver
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/log"
+)
+
+// Each cached JAR has a sidecar file listing the .proto files it contains, one per line.
+//
+// JARs in local repositories are not cached, so their index is kept in the cache on its own, and
+// is rebuilt whenever the JAR is modified.
+const indexSuffix = ".index"
+
+// Sidecar files kept next to each cached JAR, which are removed along with it.
+var jarSidecarSuffixes = []string{checksumSuffix, indexSuffix}
+
+// An archiveIndex maps each import to the first of a set of archives that provides it.
+//
+// Only .proto files are indexed, as nothing else can be imported.
+type archiveIndex map[string]indexedProto
+
+type indexedProto struct {
+	archive *openArchive
+	// Name of the file in the archive.
+	name   string
+	origin Origin
+}
+
+// Add the protos in archive under stripPrefix to the index, unless an earlier archive provides them.
+func (x archiveIndex) add(archive *openArchive, stripPrefix string, origin Origin) {
+	prefix := ""
+	if stripPrefix != "" {
+		prefix = strings.TrimSuffix(stripPrefix, "/") + "/"
+	}
+	for _, name := range archive.protos {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		imp := strings.TrimPrefix(name, prefix)
+		if _, ok := x[imp]; !ok {
+			x[imp] = indexedProto{archive: archive, name: name, origin: origin}
+		}
+	}
+}
+
+// Open an import, returning (nil, nil) if no archive provides it.
+func (x archiveIndex) open(ctx context.Context, imp string) (NamedReadCloser, error) {
+	proto, ok := x[imp]
+	if !ok {
+		return nil, nil
+	}
+	return proto.archive.open(ctx, proto.name, imp, proto.origin)
+}
+
+// Read the index of the archive, building and persisting it if it is missing or stale.
+func (a *openArchive) readIndex(ctx context.Context) error {
+	if protos, ok := readFreshIndex(a.indexPath, a.path); ok {
+		a.protos = protos
+		return nil
+	}
+	zr, err := a.reader(ctx)
+	if err != nil {
+		return err
+	}
+	a.protos = archiveProtos(&zr.Reader)
+	if err := writeArchiveIndex(a.indexPath, a.protos); err != nil {
+		log.Warnf("Could not write index of %s: %s", a.path, err)
+	}
+	return nil
+}
+
+// Read the index at indexPath, returning false if it is missing or older than the archive at path.
+func readFreshIndex(indexPath, path string) ([]string, bool) {
+	archiveInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	indexInfo, err := os.Stat(indexPath)
+	if err != nil || indexInfo.ModTime().Before(archiveInfo.ModTime()) {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, false
+	}
+	return strings.Fields(string(data)), true
+}
+
+// List the .proto files in an archive, sorted by name.
+func archiveProtos(zr *zip.Reader) []string {
+	protos := []string{}
+	for _, file := range zr.File {
+		if strings.HasSuffix(file.Name, ".proto") {
+			protos = append(protos, file.Name)
+		}
+	}
+	sort.Strings(protos)
+	return protos
+}
+
+// Atomically write an index of protos to indexPath.
+func writeArchiveIndex(indexPath string, protos []string) error {
+	w, err := ioutil.TempFile(filepath.Dir(indexPath), filepath.Base(indexPath)+"-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(w.Name()) // Fails harmlessly once renamed into place.
+	defer w.Close()
+	bw := bufio.NewWriter(w)
+	for _, proto := range protos {
+		_, _ = bw.WriteString(proto + "\n")
+	}
+	if err := bw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := w.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(w.Name(), indexPath))
+}
+
+// Read the index of protos in the archive at path, building and persisting it if necessary.
+func readArchiveIndex(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path + indexSuffix)
+	if err == nil {
+		return strings.Fields(string(data)), nil
+	} else if !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	defer zr.Close()
+	protos := archiveProtos(&zr.Reader)
+	return protos, writeArchiveIndex(path+indexSuffix, protos)
+}
@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 
@@ -9,7 +10,10 @@ import (
 
 // Local tries to resolve imports locally.
 func Local(includes []string) Resolver {
-	return func(path string) (NamedReadCloser, error) {
+	return func(ctx context.Context, path string) (NamedReadCloser, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.WithStack(err)
+		}
 		for _, include := range includes {
 			roots, err := filepath.Glob(include)
 			if err != nil {
@@ -23,7 +27,11 @@ func Local(includes []string) Resolver {
 				} else if err != nil {
 					return nil, errors.WithStack(err)
 				}
-				return r, nil
+				return &namedReadCloser{
+					name:       localPath,
+					origin:     Origin{Resolver: "local", Source: localPath},
+					ReadCloser: r,
+				}, nil
 			}
 		}
 		return nil, nil
@@ -0,0 +1,184 @@
+package resolver
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// How specifically a repository matches an import, from least to most specific.
+const (
+	matchNone = iota
+	matchPrefix
+	matchPattern
+	matchProto
+)
+
+// repoMatcher selects the repository that serves an import.
+//
+// An import listed in a repository's "protos" is the most specific match, followed by a "match"
+// pattern, followed by the longest matching "prefix" or mapped prefix.
+type repoMatcher struct {
+	repos    []Repo
+	patterns [][]func(string) bool
+}
+
+func newRepoMatcher(repos []Repo) (*repoMatcher, error) {
+	m := &repoMatcher{repos: repos}
+	for _, repo := range repos {
+		for _, mapping := range repo.Map {
+			// Mapped prefixes are directories, so that eg. "acme/foo" can't capture "acme/foobar/".
+			if !strings.HasSuffix(mapping.Import, "/") {
+				return nil, errors.Errorf("%s: mapped import prefix %q must end in \"/\"", repo.URL, mapping.Import)
+			}
+		}
+		patterns := []func(string) bool{}
+		for _, pattern := range repo.Match {
+			match, err := compileMatch(pattern)
+			if err != nil {
+				return nil, errors.Wrap(err, repo.URL)
+			}
+			patterns = append(patterns, match)
+		}
+		m.patterns = append(m.patterns, patterns)
+	}
+	return m, nil
+}
+
+// Compile a glob, or a regular expression delimited by slashes.
+func compileMatch(pattern string) (func(string) bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid match pattern %q", pattern)
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid match pattern %q", pattern)
+	}
+	return func(s string) bool {
+		ok, _ := path.Match(pattern, s)
+		return ok
+	}, nil
+}
+
+// Return the repository serving imp, or nil if there is none.
+func (m *repoMatcher) match(imp string) (*Repo, error) {
+	var best []*Repo
+	bestKind, bestLen := matchNone, 0
+	for i := range m.repos {
+		kind, length := m.specificity(i, imp)
+		switch {
+		case kind == matchNone:
+		case kind > bestKind || (kind == bestKind && length > bestLen):
+			best = []*Repo{&m.repos[i]}
+			bestKind, bestLen = kind, length
+		case kind == bestKind && length == bestLen:
+			best = append(best, &m.repos[i])
+		}
+	}
+	switch len(best) {
+	case 0:
+		return nil, nil
+	case 1:
+		return best[0], nil
+	default:
+		urls := []string{}
+		for _, repo := range best {
+			urls = append(urls, repo.URL)
+		}
+		return nil, errors.Errorf("%s is ambiguous, it matches repositories %s equally", imp, strings.Join(urls, ", "))
+	}
+}
+
+// MatchRepo returns the repository in repos that an import is resolved from, or nil if none match.
+func MatchRepo(repos []Repo, imp string) (*Repo, error) {
+	m, err := newRepoMatcher(repos)
+	if err != nil {
+		return nil, err
+	}
+	return m.match(imp)
+}
+
+func (m *repoMatcher) specificity(i int, imp string) (kind, length int) {
+	repo := &m.repos[i]
+	for _, proto := range repo.Protos {
+		if proto == imp {
+			return matchProto, 0
+		}
+	}
+	for _, match := range m.patterns[i] {
+		if match(imp) {
+			return matchPattern, 0
+		}
+	}
+	for _, prefix := range repo.prefixes() {
+		if strings.HasPrefix(imp, prefix) && len(prefix) > length {
+			kind, length = matchPrefix, len(prefix)
+		}
+	}
+	return kind, length
+}
+
+// Prefixes of imports in the repository, including mapped prefixes.
+func (r *Repo) prefixes() []string {
+	prefixes := []string{}
+	if r.Prefix != "" {
+		prefixes = append(prefixes, r.Prefix)
+	}
+	for _, mapping := range r.Map {
+		prefixes = append(prefixes, mapping.Import)
+	}
+	return prefixes
+}
+
+// ValidateRepos checks that repository definitions are valid and that no two repositories
+// claim the same imports equally, which would make resolution ambiguous.
+//
+// A proto listed by one repository may also match another's prefix or "match" pattern, as listed
+// protos take precedence. Overlapping "match" patterns can only be detected when an import is resolved.
+func ValidateRepos(repos []Repo) error {
+	if _, err := newRepoMatcher(repos); err != nil {
+		return err
+	}
+	// Repositories are identified by their position, as the same URL may be configured several times.
+	name := func(i int) string {
+		for j, other := range repos {
+			if j != i && other.URL == repos[i].URL && repos[i].CommitHash != "" {
+				return fmt.Sprintf("%s at %q", repos[i].URL, repos[i].CommitHash)
+			}
+		}
+		return repos[i].URL
+	}
+	claimed := map[string]int{}
+	claim := func(i int, kind, value string) error {
+		key := kind + " " + value
+		if other, ok := claimed[key]; ok && other != i {
+			return errors.Errorf("repositories %s and %s are ambiguous, both have %s %q", name(other), name(i), kind, value)
+		}
+		claimed[key] = i
+		return nil
+	}
+	for i, repo := range repos {
+		for _, prefix := range repo.prefixes() {
+			if err := claim(i, "prefix", prefix); err != nil {
+				return err
+			}
+		}
+		for _, proto := range repo.Protos {
+			if err := claim(i, "proto", proto); err != nil {
+				return err
+			}
+		}
+		for _, pattern := range repo.Match {
+			if err := claim(i, "match", pattern); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
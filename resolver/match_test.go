@@ -0,0 +1,110 @@
+package resolver // nolint: testpackage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepoMatcher(t *testing.T) {
+	t.Parallel()
+	repos := []Repo{
+		{URL: "googleapis", Prefix: "google/"},
+		{URL: "protobuf", Prefix: "google/protobuf/"},
+		{URL: "acme-apis", Match: []string{"acme/*/v1/*.proto"}},
+		{URL: "acme-internal", Match: []string{`/^acme/.*_internal\.proto$/`}, Protos: []string{"google/protobuf/special.proto"}},
+	}
+	m, err := newRepoMatcher(repos)
+	require.NoError(t, err)
+	tests := []struct {
+		imp      string
+		expected string
+	}{
+		{"google/api/http.proto", "googleapis"},
+		{"google/protobuf/any.proto", "protobuf"},
+		{"google/protobuf/special.proto", "acme-internal"},
+		{"acme/foo/v1/foo.proto", "acme-apis"},
+		{"acme/foo/v2/foo_internal.proto", "acme-internal"},
+		{"acme/foo/v1/foo/bar.proto", ""},
+	}
+	for _, test := range tests {
+		repo, err := m.match(test.imp)
+		require.NoError(t, err, test.imp)
+		if test.expected == "" {
+			require.Nil(t, repo, test.imp)
+		} else {
+			require.NotNil(t, repo, test.imp)
+			require.Equal(t, test.expected, repo.URL, test.imp)
+		}
+	}
+
+	_, err = m.match("acme/foo/v1/foo_internal.proto")
+	require.EqualError(t, err, "acme/foo/v1/foo_internal.proto is ambiguous, it matches repositories acme-apis, acme-internal equally")
+}
+
+func TestValidateRepos(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, ValidateRepos([]Repo{{URL: "a", Prefix: "google/"}, {URL: "b", Prefix: "google/protobuf/"}}))
+	err := ValidateRepos([]Repo{{URL: "a", Prefix: "google/"}, {URL: "b", Prefix: "google/"}})
+	require.EqualError(t, err, `repositories a and b are ambiguous, both have prefix "google/"`)
+	err = ValidateRepos([]Repo{{URL: "a", Protos: []string{"a.proto"}}, {URL: "b", Protos: []string{"a.proto"}}})
+	require.EqualError(t, err, `repositories a and b are ambiguous, both have proto "a.proto"`)
+	err = ValidateRepos([]Repo{{URL: "a", Prefix: "google/", CommitHash: "v1"}, {URL: "a", Prefix: "google/", CommitHash: "v2"}})
+	require.EqualError(t, err, `repositories a at "v1" and a at "v2" are ambiguous, both have prefix "google/"`)
+	require.NoError(t, ValidateRepos([]Repo{{URL: "a", Prefix: "google/", CommitHash: "v1"}, {URL: "a", Prefix: "acme/", CommitHash: "v2"}}))
+	// Listed protos override other repositories' prefixes and patterns.
+	require.NoError(t, ValidateRepos([]Repo{{URL: "a", Protos: []string{"google/a.proto"}}, {URL: "b", Prefix: "google/"}}))
+	require.NoError(t, ValidateRepos([]Repo{{URL: "a", Protos: []string{"acme/v1/a.proto"}}, {URL: "b", Match: []string{"acme/*/*.proto"}}}))
+	err = ValidateRepos([]Repo{{URL: "a", Match: []string{"/(/"}}})
+	require.Error(t, err)
+}
+
+func TestRepoPathMapping(t *testing.T) {
+	t.Parallel()
+	repo := Repo{
+		URL:    "acme",
+		Root:   "src",
+		Prefix: "acme/",
+		Map: []PathMapping{
+			{Import: "acme/foo/v1/", Path: "proto/v1/"},
+			{Import: "acme/foo/v1/internal/", Path: "internal/proto/"},
+		},
+	}
+	tests := []struct {
+		imp      string
+		repoPath string
+	}{
+		{"acme/foo/v1/foo.proto", "proto/v1/foo.proto"},
+		{"acme/foo/v1/internal/secret.proto", "internal/proto/secret.proto"},
+		{"acme/bar/bar.proto", "src/acme/bar/bar.proto"},
+		{"acme/foo/v1beta/foo.proto", "src/acme/foo/v1beta/foo.proto"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.repoPath, repo.RepoPath(test.imp))
+	}
+	require.Equal(t, []string{"src", "proto/v1/", "internal/proto/"}, repo.sparsePaths())
+
+	// Without a root, mapped repositories still check out only the directories they need.
+	mapped := Repo{URL: "acme", Map: []PathMapping{{Import: "acme/foo/", Path: "proto/"}}}
+	require.Equal(t, []string{"proto/"}, mapped.sparsePaths())
+	mapped.Prefix = "acme/"
+	mapped.Protos = []string{"acme/foo/a.proto", "other/b.proto"}
+	require.Equal(t, []string{"proto/", "acme", "other"}, mapped.sparsePaths())
+	mapped.Protos = []string{"c.proto"}
+	require.Nil(t, mapped.sparsePaths())
+	mapped.Protos = nil
+	mapped.Match = []string{"*.proto"}
+	require.Nil(t, mapped.sparsePaths())
+	require.Nil(t, (&Repo{URL: "acme", Prefix: "acme/"}).sparsePaths())
+
+	// Mapped prefixes select the repository.
+	m, err := newRepoMatcher([]Repo{{URL: "other", Prefix: "acme/foo/"}, repo})
+	require.NoError(t, err)
+	selected, err := m.match("acme/foo/v1/foo.proto")
+	require.NoError(t, err)
+	require.Equal(t, "acme", selected.URL)
+
+	// Mapped prefixes must be directories.
+	err = ValidateRepos([]Repo{{URL: "acme", Map: []PathMapping{{Import: "acme/foo", Path: "proto/"}}}})
+	require.EqualError(t, err, `acme: mapped import prefix "acme/foo" must end in "/"`)
+}
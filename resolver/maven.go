@@ -0,0 +1,563 @@
+package resolver
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/log"
+)
+
+// MavenConfig defines a Maven-layout repository, such as Maven Central, Nexus or a local
+// ~/.m2/repository, and the artifacts to resolve protos from.
+type MavenConfig struct {
+	URL         string                `hcl:"url" help:"Repository URL, eg. \"https://repo.maven.apache.org/maven2\", or local directory, eg. \"~/.m2/repository\"."`
+	Transitive  bool                  `hcl:"transitive,optional" help:"Also resolve protos from the compile and runtime dependencies declared in each artifact's POM."`
+	Artifacts   []MavenArtifactConfig `hcl:"artifact,block" help:"Artifacts to resolve protos from, in order."`
+	Credentials []CredentialConfig    `hcl:"credentials,block" help:"Credentials for the repository host. ~/.netrc is used by default."`
+}
+
+// Maven resolves protobufs from JARs in a Maven repository.
+//
+// Artifacts are searched in the order they are configured followed, if "transitive" is set, by
+// their dependencies, breadth first, through a single index of the protos they contain. Artifacts in a local repository are used in place, while
+// others are downloaded and cached.
+func Maven(config MavenConfig) Resolver {
+	client := &mavenClient{creds: newCredentialStore(config.Credentials)}
+	var lock sync.Mutex
+	var index archiveIndex
+	return func(ctx context.Context, path string) (NamedReadCloser, error) {
+		lock.Lock()
+		if index == nil {
+			archives, err := openMavenArchives(ctx, client, config)
+			if err != nil {
+				lock.Unlock()
+				return nil, errors.Wrap(err, config.URL)
+			}
+			index = archiveIndex{}
+			for _, archive := range archives {
+				index.add(archive.openArchive, archive.config.StripPrefix, Origin{Resolver: "maven", Source: archive.config.Path, Version: archive.version.file})
+			}
+		}
+		lock.Unlock()
+		return index.open(ctx, path)
+	}
+}
+
+// A mavenArchive is an open archive and the config it was opened from.
+type mavenArchive struct {
+	*openArchive
+	config MavenArtifactConfig
+}
+
+// Open the configured artifacts and, if config.Transitive is set, their dependencies.
+//
+// The first version of an artifact encountered is used, as in Maven's "nearest wins" strategy.
+func openMavenArchives(ctx context.Context, client *mavenClient, config MavenConfig) ([]mavenArchive, error) {
+	repoURL, err := mavenRepositoryURL(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	archives := []mavenArchive{}
+	queue := append([]MavenArtifactConfig{}, config.Artifacts...)
+	direct := len(queue)
+	seen := map[string]bool{}
+	for i := 0; i < len(queue); i++ {
+		artifactConfig := queue[i]
+		artifact, err := artifactConfig.artifact()
+		if err != nil {
+			return nil, err
+		}
+		key := artifact.path + ":" + artifact.classifier
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		archive, err := openJAR(ctx, client, repoURL, repoURL, artifactConfig)
+		if err != nil && i >= direct {
+			log.Warnf("Skipping dependency %s: %s", artifactConfig.Path, err)
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, artifactConfig.Path)
+		}
+		log.Debugf("Resolving protos from %s version %s", artifactConfig.Path, archive.version.file)
+		archives = append(archives, mavenArchive{openArchive: archive, config: artifactConfig})
+		if !config.Transitive {
+			continue
+		}
+		// A POM that can't be read only loses the artifact's dependencies, not the artifact itself.
+		pom, err := fetchPOM(ctx, client, repoURL, artifact.path, archive.version)
+		if err == nil {
+			var dependencies []MavenArtifactConfig
+			dependencies, err = pomDependencies(ctx, client, repoURL, pom.pathPrefix(artifact.path), pom)
+			for _, dependency := range dependencies {
+				// Dependencies are assumed to lay out their protos like the artifact depending on them.
+				dependency.StripPrefix = artifactConfig.StripPrefix
+				queue = append(queue, dependency)
+			}
+		}
+		if err != nil {
+			log.Warnf("Skipping dependencies of %s: %s", artifactConfig.Path, err)
+		}
+	}
+	return archives, nil
+}
+
+// Version keywords for MavenArtifactConfig.Version.
+const (
+	// LatestVersion is the most recently deployed version, which may be a SNAPSHOT.
+	LatestVersion = "latest"
+	// ReleaseVersion is the most recent version that is not a SNAPSHOT.
+	ReleaseVersion = "release"
+)
+
+// MavenArtifactConfig is the config for a single artifact within a Maven repository.
+type MavenArtifactConfig struct {
+	Path        string `hcl:"name,label" help:"Artifact path in the repository, eg. \"com/mycompany/protos\", or Maven coordinates optionally prefixed by a path, eg. \"com.mycompany:protos:1.0:protos\" or \"releases/com.mycompany:protos:1.0:protos\"."`
+	Version     string `hcl:"version,optional" help:"The artifact version to use: an exact version, 'latest' (the default, which may be a SNAPSHOT), 'release', or a Maven version range such as '[2.3,3.0)'. Overrides the version in Maven coordinates."`
+	Classifier  string `hcl:"classifier,optional" help:"Artifact classifier, eg. \"protos\"."`
+	Extension   string `hcl:"extension,optional" help:"Artifact extension, 'jar' (the default) or 'zip'."`
+	StripPrefix string `hcl:"strip_prefix,optional" help:"Prefix of files in the artifact to remove to form import paths, eg. \"src/main/proto/\"."`
+}
+
+// An artifact in a Maven repository.
+type artifact struct {
+	// Path of the artifact in its repository, eg. "com/mycompany/protos", which may begin with a
+	// path prefix such as an Artifactory repository name.
+	path       string
+	version    string
+	classifier string
+	extension  string
+}
+
+// Resolve the repository config, which may use Maven coordinates, to an artifact.
+func (r MavenArtifactConfig) artifact() (artifact, error) {
+	a := artifact{path: r.Path, classifier: r.Classifier, extension: r.Extension}
+	if strings.Contains(r.Path, ":") {
+		// [<repository>/]<group>:<artifact>[:<version>[:<classifier>]]
+		prefix, coordinates := "", r.Path
+		if i := strings.LastIndex(r.Path[:strings.Index(r.Path, ":")], "/"); i != -1 {
+			prefix, coordinates = r.Path[:i+1], r.Path[i+1:]
+		}
+		parts := strings.Split(coordinates, ":")
+		if len(parts) < 2 || len(parts) > 4 || parts[0] == "" || parts[1] == "" {
+			return artifact{}, errors.Errorf("%s: invalid Maven coordinates, expected group:artifact:version[:classifier]", r.Path)
+		}
+		a.path = prefix + strings.ReplaceAll(parts[0], ".", "/") + "/" + parts[1]
+		if len(parts) > 2 {
+			a.version = parts[2]
+		}
+		if len(parts) > 3 && a.classifier == "" {
+			a.classifier = parts[3]
+		}
+	}
+	if r.Version != "" {
+		a.version = r.Version
+	}
+	switch a.extension {
+	case "":
+		a.extension = "jar"
+	case "jar", "zip":
+	default:
+		return artifact{}, errors.Errorf("%s: unsupported extension %q, must be jar or zip", r.Path, a.extension)
+	}
+	return a, nil
+}
+
+// Filename of the artifact at a version.
+func (a artifact) filename(version string) string {
+	name := filepath.Base(a.path) + "-" + version
+	if a.classifier != "" {
+		name += "-" + a.classifier
+	}
+	return name + "." + a.extension
+}
+
+const snapshotSuffix = "-SNAPSHOT"
+
+// A timestamped SNAPSHOT version, eg. 1.0-20210102.030405-6
+var timestampedSnapshotRe = regexp.MustCompile(`^(.*)-(\d{8}\.\d{6})-(\d+)$`)
+
+// An artifactVersion is a resolved version of a Maven artifact.
+type artifactVersion struct {
+	// Dir is the version directory in the repository, eg. "1.0-SNAPSHOT".
+	dir string
+	// File is the version in the artifact filename, eg. "1.0-20210102.030405-6".
+	file string
+}
+
+func exactVersion(version string) artifactVersion {
+	if groups := timestampedSnapshotRe.FindStringSubmatch(version); groups != nil {
+		return artifactVersion{dir: groups[1] + snapshotSuffix, file: version}
+	}
+	return artifactVersion{dir: version, file: version}
+}
+
+// A mavenClient fetches files from a Maven-layout repository over HTTP, or from a local
+// directory with a file:// URL.
+type mavenClient struct {
+	creds *credentialStore
+	// Environment variable containing an Artifactory API key, used when a credential has no username.
+	apiKeyEnv string
+	// Host the API key in apiKeyEnv is sent to, as it is only valid for Artifactory itself.
+	apiKeyHost string
+}
+
+var mavenHTTPClient = func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.RegisterProtocol("file", localRepositoryTransport{})
+	return &http.Client{Transport: transport, CheckRedirect: stripHeadersOnRedirect}
+}()
+
+// GET a URL from the repository, authenticating with the credentials for its host.
+func (c *mavenClient) get(ctx context.Context, srcURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srcURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, srcURL)
+	}
+	if req.URL.Scheme != "file" {
+		env := ""
+		if req.URL.Host == c.apiKeyHost {
+			env = c.apiKeyEnv
+		}
+		cred, err := c.creds.lookup(req.URL.Host, env)
+		if err != nil {
+			return nil, err
+		} else if cred != nil && cred.username == "" && cred.secret != "" && c.apiKeyEnv != "" {
+			req.Header.Set("X-JFrog-Art-Api", cred.secret)
+		} else if cred != nil {
+			cred.basicOrBearer(req.Header)
+		}
+	}
+	resp, err := mavenHTTPClient.Do(req)
+	return resp, errors.Wrap(err, srcURL)
+}
+
+// localRepositoryTransport serves file:// URLs from a local Maven repository, such as ~/.m2/repository.
+type localRepositoryTransport struct{}
+
+func (localRepositoryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := req.URL.Path
+	if len(path) > 1 && filepath.VolumeName(path[1:]) != "" {
+		path = path[1:]
+	}
+	path = filepath.FromSlash(path)
+	f, err := os.Open(path)
+	// Local repositories name their metadata maven-metadata-local.xml.
+	if os.IsNotExist(err) && filepath.Base(path) == "maven-metadata.xml" {
+		f, err = os.Open(filepath.Join(filepath.Dir(path), "maven-metadata-local.xml"))
+	}
+	resp := &http.Response{
+		Proto:         "HTTP/1.0",
+		ProtoMajor:    1,
+		Header:        http.Header{},
+		Body:          http.NoBody,
+		ContentLength: -1,
+		Request:       req,
+	}
+	if os.IsNotExist(err) {
+		resp.StatusCode = http.StatusNotFound
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	} else {
+		resp.StatusCode = http.StatusOK
+		resp.Body = f
+		if info, err := f.Stat(); err == nil {
+			resp.ContentLength = info.Size()
+		}
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	return resp, nil
+}
+
+// Return the URL of a Maven repository, converting a local directory to a file:// URL.
+func mavenRepositoryURL(repository string) (string, error) {
+	if strings.Contains(repository, "://") {
+		return strings.TrimSuffix(repository, "/"), nil
+	}
+	path, err := filepath.Abs(expandHome(repository))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		// Windows paths, eg. file:///C:/Users.
+		path = "/" + path
+	}
+	return "file://" + path, nil
+}
+
+// Maven repository metadata, from maven-metadata.xml.
+type mavenMetadata struct {
+	Versioning struct {
+		Latest   string   `xml:"latest"`
+		Release  string   `xml:"release"`
+		Versions []string `xml:"versions>version"`
+		Snapshot struct {
+			Timestamp   string `xml:"timestamp"`
+			BuildNumber string `xml:"buildNumber"`
+		} `xml:"snapshot"`
+		SnapshotVersions []struct {
+			Classifier string `xml:"classifier"`
+			Extension  string `xml:"extension"`
+			Value      string `xml:"value"`
+		} `xml:"snapshotVersions>snapshotVersion"`
+	} `xml:"versioning"`
+}
+
+func fetchMavenMetadata(ctx context.Context, client *mavenClient, metadataURL string) (*mavenMetadata, error) {
+	resp, err := client.get(ctx, metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	log.Debugf("  <- %s (%s)", metadataURL, FormatSize(resp.ContentLength))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.Errorf("%s: %s", metadataURL, resp.Status)
+	}
+	metadata := &mavenMetadata{}
+	if err := xml.NewDecoder(resp.Body).Decode(metadata); err != nil {
+		return nil, errors.Wrap(err, metadataURL)
+	}
+	return metadata, nil
+}
+
+// Resolve a version specification (an exact version, "latest", "release" or a range) for the artifact
+// at artifactURL, which contains maven-metadata.xml.
+func resolveArtifactVersion(ctx context.Context, client *mavenClient, artifactURL, spec, classifier, extension string) (artifactVersion, error) {
+	var version string
+	switch {
+	case spec == "" || spec == LatestVersion:
+		metadata, err := fetchMavenMetadata(ctx, client, artifactURL+"/maven-metadata.xml")
+		if err != nil {
+			return artifactVersion{}, err
+		}
+		if version = metadata.Versioning.Latest; version == "" {
+			return artifactVersion{}, errors.Errorf("no latest version published for %s", artifactURL)
+		}
+	case spec == ReleaseVersion || isVersionRange(spec):
+		metadata, err := fetchMavenMetadata(ctx, client, artifactURL+"/maven-metadata.xml")
+		if err != nil {
+			return artifactVersion{}, err
+		}
+		if version, err = selectVersion(metadata, spec); err != nil {
+			return artifactVersion{}, errors.Wrap(err, artifactURL)
+		}
+	default:
+		version = spec
+	}
+	if !strings.HasSuffix(version, snapshotSuffix) {
+		return exactVersion(version), nil
+	}
+	// SNAPSHOTs are deployed with a timestamped filename, recorded in the per-version metadata.
+	metadata, err := fetchMavenMetadata(ctx, client, artifactURL+"/"+version+"/maven-metadata.xml")
+	if err != nil {
+		return artifactVersion{}, err
+	}
+	for _, snapshot := range metadata.Versioning.SnapshotVersions {
+		if snapshot.Classifier == classifier && snapshot.Extension == extension {
+			return artifactVersion{dir: version, file: snapshot.Value}, nil
+		}
+	}
+	if snapshot := metadata.Versioning.Snapshot; snapshot.Timestamp != "" {
+		base := strings.TrimSuffix(version, snapshotSuffix)
+		return artifactVersion{dir: version, file: fmt.Sprintf("%s-%s-%s", base, snapshot.Timestamp, snapshot.BuildNumber)}, nil
+	}
+	// Non-unique SNAPSHOTs are deployed without a timestamp.
+	return artifactVersion{dir: version, file: version}, nil
+}
+
+// Select the "release" version, or the highest release version in a range.
+func selectVersion(metadata *mavenMetadata, spec string) (string, error) {
+	if spec == ReleaseVersion && metadata.Versioning.Release != "" {
+		return metadata.Versioning.Release, nil
+	}
+	var ranges []versionRange
+	if spec != ReleaseVersion {
+		var err error
+		if ranges, err = parseVersionRanges(spec); err != nil {
+			return "", err
+		}
+	}
+	best := ""
+	for _, version := range metadata.Versioning.Versions {
+		if strings.HasSuffix(version, snapshotSuffix) {
+			continue
+		}
+		if ranges != nil && !inRanges(ranges, version) {
+			continue
+		}
+		if best == "" || compareVersions(version, best) > 0 {
+			best = version
+		}
+	}
+	if best == "" {
+		return "", errors.Errorf("no released version matches %q", spec)
+	}
+	return best, nil
+}
+
+// A versionRange is a single Maven version range, eg. [1.0,2.0).
+type versionRange struct {
+	lower, upper                   string
+	lowerInclusive, upperInclusive bool
+}
+
+func isVersionRange(spec string) bool {
+	return strings.HasPrefix(spec, "[") || strings.HasPrefix(spec, "(")
+}
+
+// Parse a Maven version range specification, eg. "[1.0,2.0)" or "(,1.0],[1.2,)".
+func parseVersionRanges(spec string) ([]versionRange, error) {
+	ranges := []versionRange{}
+	rest := strings.ReplaceAll(spec, " ", "")
+	for rest != "" {
+		end := strings.IndexAny(rest, "])")
+		if end == -1 || !isVersionRange(rest) {
+			return nil, errors.Errorf("invalid version range %q", spec)
+		}
+		bounds := strings.Split(rest[1:end], ",")
+		r := versionRange{lowerInclusive: rest[0] == '[', upperInclusive: rest[end] == ']'}
+		switch len(bounds) {
+		case 1:
+			// [1.0] is exactly 1.0.
+			if !r.lowerInclusive || !r.upperInclusive {
+				return nil, errors.Errorf("invalid version range %q", spec)
+			}
+			r.lower, r.upper = bounds[0], bounds[0]
+		case 2:
+			r.lower, r.upper = bounds[0], bounds[1]
+		default:
+			return nil, errors.Errorf("invalid version range %q", spec)
+		}
+		ranges = append(ranges, r)
+		rest = strings.TrimPrefix(rest[end+1:], ",")
+	}
+	return ranges, nil
+}
+
+func inRanges(ranges []versionRange, version string) bool {
+	for _, r := range ranges {
+		if r.lower != "" {
+			cmp := compareVersions(version, r.lower)
+			if cmp < 0 || (cmp == 0 && !r.lowerInclusive) {
+				continue
+			}
+		}
+		if r.upper != "" {
+			cmp := compareVersions(version, r.upper)
+			if cmp > 0 || (cmp == 0 && !r.upperInclusive) {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Well known Maven qualifiers, in ascending order. Unknown qualifiers sort after these,
+// alphabetically.
+var qualifierOrder = map[string]int{
+	"alpha":     1,
+	"a":         1,
+	"beta":      2,
+	"b":         2,
+	"milestone": 3,
+	"m":         3,
+	"rc":        4,
+	"cr":        4,
+	"snapshot":  5,
+	"":          6,
+	"ga":        6,
+	"final":     6,
+	"release":   6,
+	"sp":        7,
+}
+
+// Compare two Maven versions, returning -1, 0 or 1.
+//
+// This is a simplification of Maven's ComparableVersion: numeric components are compared
+// numerically, and qualifiers such as "rc" sort before the release.
+func compareVersions(a, b string) int {
+	as, bs := splitVersion(a), splitVersion(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var ac, bc string
+		if i < len(as) {
+			ac = as[i]
+		}
+		if i < len(bs) {
+			bc = bs[i]
+		}
+		if cmp := compareVersionComponents(ac, bc); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+func splitVersion(version string) []string {
+	components := []string{}
+	for _, component := range strings.FieldsFunc(strings.ToLower(version), func(r rune) bool { return r == '.' || r == '-' }) {
+		// Split transitions between digits and letters, eg. "rc1" -> "rc", "1".
+		start := 0
+		for i := 1; i < len(component); i++ {
+			if isDigit(component[i]) != isDigit(component[i-1]) {
+				components = append(components, component[start:i])
+				start = i
+			}
+		}
+		components = append(components, component[start:])
+	}
+	return components
+}
+
+func compareVersionComponents(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareInts(an, bn)
+	case aErr == nil:
+		// Numbers sort after qualifiers, and a missing component is equivalent to 0.
+		if b == "" {
+			return compareInts(an, 0)
+		}
+		return 1
+	case bErr == nil:
+		return -compareVersionComponents(b, a)
+	}
+	ao, aKnown := qualifierOrder[a]
+	bo, bKnown := qualifierOrder[b]
+	switch {
+	case aKnown && bKnown:
+		return compareInts(ao, bo)
+	case aKnown:
+		return -1
+	case bKnown:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
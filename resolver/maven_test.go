@@ -0,0 +1,210 @@
+package resolver // nolint: testpackage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareVersions(t *testing.T) {
+	t.Parallel()
+	ordered := []string{"1.0-alpha1", "1.0-beta", "1.0-rc1", "1.0-rc2", "1.0-SNAPSHOT", "1.0", "1.0-sp1", "1.0.1", "1.2", "1.10", "2"}
+	for i := range ordered {
+		for j := range ordered {
+			expected := compareInts(i, j)
+			require.Equal(t, expected, compareVersions(ordered[i], ordered[j]), "%s <=> %s", ordered[i], ordered[j])
+		}
+	}
+	require.Equal(t, 0, compareVersions("1.0", "1.0.0"))
+}
+
+func TestSelectVersion(t *testing.T) {
+	t.Parallel()
+	metadata := &mavenMetadata{}
+	metadata.Versioning.Versions = []string{"1.0", "2.3", "2.10", "3.0", "3.1-SNAPSHOT"}
+	tests := []struct {
+		spec     string
+		expected string
+		err      string
+	}{
+		{spec: "release", expected: "3.0"},
+		{spec: "[2.3,3.0)", expected: "2.10"},
+		{spec: "[2.3,3.0]", expected: "3.0"},
+		{spec: "(,2.3)", expected: "1.0"},
+		{spec: "(,1.0),[2.0,2.5)", expected: "2.3"},
+		{spec: "[2.3]", expected: "2.3"},
+		{spec: "[4.0,)", err: `no released version matches "[4.0,)"`},
+		{spec: "[1.0", err: `invalid version range "[1.0"`},
+	}
+	for _, test := range tests {
+		version, err := selectVersion(metadata, test.spec)
+		if test.err != "" {
+			require.EqualError(t, err, test.err, test.spec)
+		} else {
+			require.NoError(t, err, test.spec)
+			require.Equal(t, test.expected, version, test.spec)
+		}
+	}
+	metadata.Versioning.Release = "2.10"
+	version, err := selectVersion(metadata, "release")
+	require.NoError(t, err)
+	require.Equal(t, "2.10", version)
+}
+
+func TestResolveSnapshotVersion(t *testing.T) {
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repo/protos/maven-metadata.xml":
+			_, _ = w.Write([]byte(`<metadata><versioning><latest>1.1-SNAPSHOT</latest><release>1.0</release></versioning></metadata>`))
+		case "/repo/unreleased/maven-metadata.xml":
+			_, _ = w.Write([]byte(`<metadata><versioning><versions></versions></versioning></metadata>`))
+		case "/repo/protos/1.1-SNAPSHOT/maven-metadata.xml":
+			_, _ = w.Write([]byte(`<metadata><versioning>
+				<snapshot><timestamp>20210102.030405</timestamp><buildNumber>6</buildNumber></snapshot>
+				<snapshotVersions>
+					<snapshotVersion><extension>pom</extension><value>1.1-20210102.030405-6</value></snapshotVersion>
+					<snapshotVersion><extension>jar</extension><value>1.1-20210102.030405-6</value></snapshotVersion>
+				</snapshotVersions>
+			</versioning></metadata>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	version, err := resolveArtifactVersion(ctx, &mavenClient{}, srv.URL+"/repo/protos", "", "", "jar")
+	require.NoError(t, err)
+	require.Equal(t, artifactVersion{dir: "1.1-SNAPSHOT", file: "1.1-20210102.030405-6"}, version)
+
+	version, err = resolveArtifactVersion(ctx, &mavenClient{}, srv.URL+"/repo/protos", "release", "", "jar")
+	require.NoError(t, err)
+	require.Equal(t, artifactVersion{dir: "1.0", file: "1.0"}, version)
+
+	// Missing metadata, or metadata without a latest version, is an error rather than a version.
+	_, err = resolveArtifactVersion(ctx, &mavenClient{}, srv.URL+"/repo/missing", LatestVersion, "", "jar")
+	require.EqualError(t, err, srv.URL+"/repo/missing/maven-metadata.xml: 404 Not Found")
+	_, err = resolveArtifactVersion(ctx, &mavenClient{}, srv.URL+"/repo/unreleased", LatestVersion, "", "jar")
+	require.EqualError(t, err, "no latest version published for "+srv.URL+"/repo/unreleased")
+
+	// Timestamped versions, eg. from the lock, map back to their SNAPSHOT directory.
+	require.Equal(t, artifactVersion{dir: "1.1-SNAPSHOT", file: "1.1-20210102.030405-6"}, exactVersion("1.1-20210102.030405-6"))
+}
+
+func TestMavenTransitive(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	// Parents and dependencies are looked up under the repository path prefix of the artifact.
+	for _, prefix := range []string{"", "jar-releases/"} {
+		repo := t.TempDir()
+		write := func(path, content string) {
+			path = filepath.Join(repo, filepath.FromSlash(prefix+path))
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+			require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o600))
+		}
+		writeJAR := func(path, proto string) {
+			write(path, string(buildJAR(t, map[string]string{"src/main/proto/" + proto: `syntax = "proto3";`})))
+		}
+		write("com/acme/api/maven-metadata-local.xml", `<metadata><versioning><latest>1.0</latest></versioning></metadata>`)
+		writeJAR("com/acme/api/1.0/api-1.0.jar", "acme/api.proto")
+		write("com/acme/api/1.0/api-1.0.pom", `<project>
+			<parent><groupId>com.acme</groupId><artifactId>parent</artifactId><version>1</version></parent>
+			<artifactId>api</artifactId>
+			<dependencies>
+				<dependency><groupId>${project.groupId}</groupId><artifactId>common</artifactId></dependency>
+				<dependency><groupId>com.acme</groupId><artifactId>nopom</artifactId><version>1.0</version></dependency>
+				<dependency><groupId>junit</groupId><artifactId>junit</artifactId><version>4.13</version><scope>test</scope></dependency>
+				<dependency><groupId>com.acme</groupId><artifactId>extra</artifactId><version>1.0</version><optional>true</optional></dependency>
+			</dependencies>
+		</project>`)
+		write("com/acme/parent/1/parent-1.pom", `<project>
+			<groupId>com.acme</groupId><artifactId>parent</artifactId><version>1</version>
+			<properties><common.version>2.0</common.version></properties>
+			<dependencyManagement><dependencies>
+				<dependency><groupId>com.acme</groupId><artifactId>common</artifactId><version>${common.version}</version></dependency>
+			</dependencies></dependencyManagement>
+		</project>`)
+		writeJAR("com/acme/common/2.0/common-2.0.jar", "acme/common.proto")
+		write("com/acme/common/2.0/common-2.0.pom", `<project><groupId>com.acme</groupId><artifactId>common</artifactId><version>2.0</version></project>`)
+		// A dependency without a POM is still searched, but its own dependencies are skipped.
+		writeJAR("com/acme/nopom/1.0/nopom-1.0.jar", "acme/nopom.proto")
+
+		config := MavenConfig{URL: repo, Artifacts: []MavenArtifactConfig{{Path: prefix + "com.acme:api", StripPrefix: "src/main/proto/"}}}
+		ctx := context.Background()
+		r, err := Maven(config)(ctx, "acme/api.proto")
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		require.NoError(t, r.Close())
+		require.Equal(t, Origin{Resolver: "maven", Source: prefix + "com.acme:api", Version: "1.0"}, OriginOf(r))
+		r, err = Maven(config)(ctx, "acme/common.proto")
+		require.NoError(t, err)
+		require.Nil(t, r)
+
+		config.Transitive = true
+		r, err = Maven(config)(ctx, "acme/common.proto")
+		require.NoError(t, err, prefix)
+		require.NotNil(t, r, prefix)
+		require.NoError(t, r.Close())
+		require.Equal(t, Origin{Resolver: "maven", Source: prefix + "com.acme:common:2.0", Version: "2.0"}, OriginOf(r))
+		r, err = Maven(config)(ctx, "acme/nopom.proto")
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		require.NoError(t, r.Close())
+
+		// So is a configured artifact without a POM.
+		config.Artifacts = []MavenArtifactConfig{{Path: prefix + "com.acme:nopom:1.0", StripPrefix: "src/main/proto/"}}
+		r, err = Maven(config)(ctx, "acme/nopom.proto")
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestMavenLocalIndex(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	repo := t.TempDir()
+	jar := filepath.Join(repo, "com", "acme", "api", "1.0", "api-1.0.jar")
+	require.NoError(t, os.MkdirAll(filepath.Dir(jar), 0o700))
+	require.NoError(t, ioutil.WriteFile(jar, buildJAR(t, map[string]string{"a.proto": "a"}), 0o600))
+	config := MavenConfig{URL: repo, Artifacts: []MavenArtifactConfig{{Path: "com.acme:api:1.0"}}}
+	ctx := context.Background()
+
+	// The index of a local JAR is cached, but the JAR itself is not.
+	r, err := Maven(config)(ctx, "a.proto")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	require.NoError(t, r.Close())
+	entries, err := ListCache()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, CachedJAR, entries[0].Kind)
+	require.Equal(t, "1.0", entries[0].Version)
+	require.NoFileExists(t, entries[0].Path)
+	protos, err := entries[0].Protos()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.proto"}, protos)
+
+	// It is rebuilt once the JAR is modified.
+	require.NoError(t, ioutil.WriteFile(jar, buildJAR(t, map[string]string{"b.proto": "b"}), 0o600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(jar, later, later))
+	r, err = Maven(config)(ctx, "b.proto")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	require.NoError(t, r.Close())
+	protos, err = entries[0].Protos()
+	require.NoError(t, err)
+	require.Equal(t, []string{"b.proto"}, protos)
+
+	require.NoError(t, entries[0].Remove(ctx))
+	entries, err = ListCache()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
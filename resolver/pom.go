@@ -0,0 +1,213 @@
+package resolver
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/protosync/log"
+)
+
+// Parent POMs are followed at most this deep.
+const maxPOMDepth = 10
+
+// A Maven POM, reduced to what is needed to resolve dependencies.
+type mavenPOM struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+	Version    string `xml:"version"`
+	Parent     struct {
+		GroupID    string `xml:"groupId"`
+		ArtifactID string `xml:"artifactId"`
+		Version    string `xml:"version"`
+	} `xml:"parent"`
+	Properties struct {
+		Entries []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"properties"`
+	DependencyManagement struct {
+		Dependencies []mavenDependency `xml:"dependencies>dependency"`
+	} `xml:"dependencyManagement"`
+	Dependencies []mavenDependency `xml:"dependencies>dependency"`
+}
+
+type mavenDependency struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+	Version    string `xml:"version"`
+	Classifier string `xml:"classifier"`
+	Type       string `xml:"type"`
+	Scope      string `xml:"scope"`
+	Optional   string `xml:"optional"`
+}
+
+var pomPropertyRe = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// Fetch the POM for an artifact version, caching it unless it is in a local repository.
+func fetchPOM(ctx context.Context, client *mavenClient, repoURL, artifactPath string, version artifactVersion) (*mavenPOM, error) {
+	filename := fmt.Sprintf("%s-%s.pom", filepath.Base(artifactPath), version.file)
+	pomURL := fmt.Sprintf("%s/%s/%s/%s", repoURL, artifactPath, version.dir, filename)
+	local := strings.HasPrefix(repoURL, "file://")
+	cached := ""
+	var data []byte
+	var err error
+	if !local {
+		var cacheDir string
+		if cacheDir, err = artifactCacheDir(pomCacheKind, repoURL+"/"+artifactPath); err != nil {
+			return nil, err
+		}
+		cached = filepath.Join(cacheDir, filename)
+		data, err = ioutil.ReadFile(cached)
+	}
+	if local || err != nil {
+		if IsOffline(ctx) && !local {
+			return nil, errors.Errorf("%s is not cached, and can not be downloaded offline", pomURL)
+		}
+		resp, err := client.get(ctx, pomURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, errors.Errorf("%s: %s", pomURL, resp.Status)
+		}
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, errors.Wrap(err, pomURL)
+		}
+		if !local {
+			if err := ioutil.WriteFile(cached, data, 0o600); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	} else {
+		touch(cached)
+	}
+	pom := &mavenPOM{}
+	if err := xml.Unmarshal(data, pom); err != nil {
+		_ = os.Remove(cached)
+		return nil, errors.Wrap(err, pomURL)
+	}
+	return pom, nil
+}
+
+// Fetch the POM of a version of an artifact identified by its group and artifact ID, under the
+// repository path prefix, eg. "jar-releases/".
+func fetchPOMByID(ctx context.Context, client *mavenClient, repoURL, prefix, groupID, artifactID, version string) (*mavenPOM, error) {
+	artifactPath := prefix + strings.ReplaceAll(groupID, ".", "/") + "/" + artifactID
+	resolved := exactVersion(version)
+	if !isExactVersion(version) {
+		var err error
+		resolved, err = resolveArtifactVersion(ctx, client, repoURL+"/"+artifactPath, version, "", "pom")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fetchPOM(ctx, client, repoURL, artifactPath, resolved)
+}
+
+// Repository path prefix of the artifact at artifactPath described by a POM, eg. "jar-releases/"
+// for "jar-releases/com/mycompany/protos", or "" if the path does not end with its coordinates.
+func (p *mavenPOM) pathPrefix(artifactPath string) string {
+	coordinates := strings.ReplaceAll(firstNonEmpty(p.GroupID, p.Parent.GroupID), ".", "/") + "/" + p.ArtifactID
+	if artifactPath != coordinates && !strings.HasSuffix(artifactPath, "/"+coordinates) {
+		return ""
+	}
+	return strings.TrimSuffix(artifactPath, coordinates)
+}
+
+// Resolve the dependencies declared by a POM that protos may be resolved from, following its parents
+// to interpolate properties and apply dependency management.
+//
+// Parents and dependencies are looked up under the same repository path prefix as the POM's artifact.
+// Only compile and runtime dependencies of type jar or zip that are not optional are included.
+func pomDependencies(ctx context.Context, client *mavenClient, repoURL, prefix string, pom *mavenPOM) ([]MavenArtifactConfig, error) {
+	chain := []*mavenPOM{pom}
+	for parent := pom; parent.Parent.ArtifactID != "" && len(chain) < maxPOMDepth; {
+		var err error
+		parent, err = fetchPOMByID(ctx, client, repoURL, prefix, parent.Parent.GroupID, parent.Parent.ArtifactID, parent.Parent.Version)
+		if err != nil {
+			return nil, errors.Wrap(err, "parent POM")
+		}
+		chain = append(chain, parent)
+	}
+
+	// Properties of a POM override those of its parents.
+	properties := map[string]string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, entry := range chain[i].Properties.Entries {
+			properties[entry.XMLName.Local] = strings.TrimSpace(entry.Value)
+		}
+	}
+	properties["project.groupId"] = firstNonEmpty(pom.GroupID, pom.Parent.GroupID)
+	properties["project.artifactId"] = pom.ArtifactID
+	properties["project.version"] = firstNonEmpty(pom.Version, pom.Parent.Version)
+	properties["project.parent.groupId"] = pom.Parent.GroupID
+	properties["project.parent.version"] = pom.Parent.Version
+	interpolate := func(s string) string {
+		return pomPropertyRe.ReplaceAllStringFunc(strings.TrimSpace(s), func(ref string) string {
+			if value, ok := properties[ref[2:len(ref)-1]]; ok {
+				return value
+			}
+			return ref
+		})
+	}
+
+	managed := map[string]string{}
+	for _, p := range chain {
+		for _, dep := range p.DependencyManagement.Dependencies {
+			key := interpolate(dep.GroupID) + ":" + interpolate(dep.ArtifactID)
+			if _, ok := managed[key]; !ok {
+				managed[key] = interpolate(dep.Version)
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	artifacts := []MavenArtifactConfig{}
+	for _, p := range chain {
+		for _, dep := range p.Dependencies {
+			groupID, artifactID := interpolate(dep.GroupID), interpolate(dep.ArtifactID)
+			key := groupID + ":" + artifactID
+			scope, kind := interpolate(dep.Scope), interpolate(dep.Type)
+			if seen[key] || interpolate(dep.Optional) == "true" {
+				continue
+			}
+			seen[key] = true
+			if (scope != "" && scope != "compile" && scope != "runtime") || (kind != "" && kind != "jar" && kind != "zip") {
+				continue
+			}
+			version := interpolate(dep.Version)
+			if version == "" {
+				version = managed[key]
+			}
+			if version == "" || strings.Contains(version, "${") {
+				log.Warnf("%s:%s: could not determine the version of dependency %s, skipping it", properties["project.groupId"], pom.ArtifactID, key)
+				continue
+			}
+			coordinates := prefix + key + ":" + version
+			if classifier := interpolate(dep.Classifier); classifier != "" {
+				coordinates += ":" + classifier
+			}
+			artifacts = append(artifacts, MavenArtifactConfig{Path: coordinates, Extension: kind})
+		}
+	}
+	return artifacts, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -2,18 +2,22 @@ package resolver
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/cashapp/protosync/log"
 	giturls "github.com/whilp/git-urls"
@@ -23,14 +27,80 @@ import (
 
 // Repo defines a source repository and where to retrieve protos from it.
 type Repo struct {
-	URL        string   `hcl:"url,label" help:"Git cloneable URL of repository."`
-	Root       string   `hcl:"root,optional" help:"Root path in remote repository to search for protos."`
-	Prefix     string   `hcl:"prefix,optional" help:"Prefix of proto path that will match this repository. eg. 'google'"`
-	Protos     []string `hcl:"protos,optional" help:"A list of specific .proto files that this repository contains."`
-	CommitHash string   `hcl:"commit,optional" help:"Specific commit to retrieve .proto files from."`
+	URL        string            `hcl:"url,label" help:"Git cloneable URL of repository."`
+	Root       string            `hcl:"root,optional" help:"Root path in remote repository to search for protos."`
+	Prefix     string            `hcl:"prefix,optional" help:"Prefix of proto path that will match this repository. eg. 'google'"`
+	Protos     []string          `hcl:"protos,optional" help:"A list of specific .proto files that this repository contains."`
+	Match      []string          `hcl:"match,optional" help:"Glob patterns (eg. 'acme/*/v1/*.proto') or regular expressions delimited by slashes (eg. '/^acme/.*_api[.]proto$/') matching imports this repository contains."`
+	CommitHash string            `hcl:"commit,optional" help:"Specific commit, branch or tag to retrieve .proto files from (default is the default branch)."`
+	RawURL     string            `hcl:"raw-url,optional" help:"URL template for retrieving raw files from this repository, overriding any host configuration. See remote.host.raw-url for details."`
+	Headers    map[string]string `hcl:"headers,optional" help:"HTTP headers to send with each request to raw-url."`
+	Map        []PathMapping     `hcl:"map,block" help:"Map imports with a prefix to a different path in the repository. Mapped prefixes also select this repository, like 'prefix'."`
+}
+
+// PathMapping maps imports with a prefix to a path in a repository.
+type PathMapping struct {
+	Import string `hcl:"import,label" help:"Import path prefix, ending in '/', eg. 'acme/foo/v1/'."`
+	Path   string `hcl:"path" help:"Path in the repository that the prefix maps to, eg. 'proto/v1/'."`
+}
+
+// RepoPath returns the path in the repository of an import.
+//
+// The longest matching mapped prefix is replaced with its path, otherwise the import is relative to Root.
+func (r *Repo) RepoPath(imp string) string {
+	if mapping := longestMapping(r.Map, imp); mapping != nil {
+		return path.Join(mapping.Path, strings.TrimPrefix(imp, mapping.Import))
+	}
+	return path.Join(r.Root, imp)
+}
+
+// Paths that need to be checked out to retrieve protos, or nil if the whole repository is required.
+//
+// Without a root, imports that aren't mapped are at their import path in the repository, so only the
+// directories of the prefix and listed protos are required, unless "match" patterns could match anything.
+func (r *Repo) sparsePaths() []string {
+	paths := []string{}
+	for _, mapping := range r.Map {
+		paths = append(paths, mapping.Path)
+	}
+	if r.Root != "" && r.Root != "." {
+		return append([]string{r.Root}, paths...)
+	}
+	if len(paths) == 0 || len(r.Match) > 0 {
+		return nil
+	}
+	unmapped := r.Protos
+	if r.Prefix != "" {
+		unmapped = append([]string{r.Prefix}, unmapped...)
+	}
+	for _, imp := range unmapped {
+		if longestMapping(r.Map, imp) != nil {
+			continue
+		}
+		dir := path.Dir(imp)
+		if dir == "." {
+			return nil
+		}
+		paths = append(paths, dir)
+	}
+	return paths
+}
+
+// Return the mapping with the longest import prefix of imp.
+func longestMapping(mappings []PathMapping, imp string) *PathMapping {
+	var longest *PathMapping
+	for i, mapping := range mappings {
+		if strings.HasPrefix(imp, mapping.Import) && (longest == nil || len(mapping.Import) > len(longest.Import)) {
+			longest = &mappings[i]
+		}
+	}
+	return longest
 }
 
 // Commit from which to retrieve protos.
+//
+// If no commit is configured, Remote() uses the repository's default branch, falling back to "master"
+// if it can not be determined.
 func (r *Repo) Commit() string {
 	if r.CommitHash == "" {
 		return "master"
@@ -49,37 +119,168 @@ func (r *Repo) ParseURL() (*url.URL, error) {
 
 // RemoteConfig contains the configuration for Remote().
 type RemoteConfig struct {
-	BitbucketServers []string `hcl:"bitbucket-servers,optional" help:"List of hostnames to treat as Bitbucket servers."`
+	BitbucketServers   []string           `hcl:"bitbucket-servers,optional" help:"List of hostnames to treat as Bitbucket servers."`
+	GitLabServers      []string           `hcl:"gitlab-servers,optional" help:"List of hostnames to treat as GitLab servers."`
+	Hosts              []HostConfig       `hcl:"host,block" help:"Git hosts to retrieve raw files from via a URL template."`
+	Credentials        []CredentialConfig `hcl:"credentials,block" help:"Credentials for git hosts. $GITHUB_TOKEN, $BITBUCKET_TOKEN, $GITLAB_TOKEN and ~/.netrc are used by default."`
+	MaxHostConcurrency int                `hcl:"max-host-concurrency,optional" help:"Maximum number of concurrent requests to a single host (default 4)."`
+}
+
+// DefaultMaxHostConcurrency is the maximum number of concurrent requests to a single host if not configured.
+const DefaultMaxHostConcurrency = 4
+
+// hostLimiter caps the number of concurrent requests to each host.
+type hostLimiter struct {
+	max   int
+	lock  sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newHostLimiter(max int) *hostLimiter {
+	if max <= 0 {
+		max = DefaultMaxHostConcurrency
+	}
+	return &hostLimiter{max: max, hosts: map[string]chan struct{}{}}
+}
+
+// Acquire a slot for host, blocking until one is available or ctx is cancelled.
+func (h *hostLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	h.lock.Lock()
+	sem, ok := h.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, h.max)
+		h.hosts[host] = sem
+	}
+	h.lock.Unlock()
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.WithStack(ctx.Err())
+	}
+	once := sync.Once{}
+	return func() { once.Do(func() { <-sem }) }, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
 }
 
 // Remote resolves imports from their source repositories.
+//
+// The branch or tag of each repository is resolved to a commit SHA once, the first time the repository is
+// used, and every file is then fetched from that commit so that a single sync never mixes revisions.
 func Remote(config RemoteConfig, repos []Repo) Resolver {
-	return func(path string) (NamedReadCloser, error) {
-		repo := findRepoForImport(repos, path)
-		if repo == nil {
-			return nil, nil
+	limiter := newHostLimiter(config.MaxHostConcurrency)
+	creds := newCredentialStore(config.Credentials)
+	matcher, matcherErr := newRepoMatcher(repos)
+	var pinsLock sync.Mutex
+	pins := map[string]*pinnedCommit{}
+	return func(ctx context.Context, path string) (NamedReadCloser, error) {
+		if matcherErr != nil {
+			return nil, matcherErr
+		}
+		repo, err := matcher.match(path)
+		if err != nil || repo == nil {
+			return nil, err
+		}
+		if !IsOffline(ctx) {
+			pinsLock.Lock()
+			key := repo.URL + "@" + repo.CommitHash
+			pin, ok := pins[key]
+			if !ok {
+				pin = &pinnedCommit{}
+				pins[key] = pin
+			}
+			pinsLock.Unlock()
+			commit, err := pin.resolve(ctx, limiter, repo)
+			if err != nil {
+				return nil, err
+			}
+			pinned := *repo
+			pinned.CommitHash = commit
+			repo = &pinned
+		}
+		r, err := fetchProto(ctx, config, creds, limiter, repo, path)
+		if err != nil {
+			return nil, err
 		}
-		return fetchProto(config, repo, path)
+		return &namedReadCloser{
+			name:       r.Name(),
+			origin:     Origin{Resolver: "remote", Source: repo.URL, Version: repo.Commit()},
+			ReadCloser: r,
+		}, nil
 	}
 }
 
-func findRepoForImport(repos []Repo, path string) *Repo {
-	for _, repo := range repos {
-		if repo.Prefix != "" && strings.HasPrefix(path, repo.Prefix) {
-			return &repo
+// pinnedCommit resolves the configured ref of a repository to a commit SHA at most once.
+type pinnedCommit struct {
+	once   sync.Once
+	commit string
+	err    error
+}
+
+// Resolving a ref queries the repository's host, so takes a slot from limiter like a fetch does.
+func (p *pinnedCommit) resolve(ctx context.Context, limiter *hostLimiter, repo *Repo) (string, error) {
+	p.once.Do(func() {
+		if commitSHARe.MatchString(repo.CommitHash) {
+			p.commit = repo.CommitHash
+			return
 		}
-		for _, proto := range repo.Protos {
-			if proto == path {
-				return &repo
+		if repoURL, err := repo.ParseURL(); err == nil {
+			release, err := limiter.acquire(ctx, repoURL.Host)
+			if err != nil {
+				p.err = err
+				return
 			}
+			defer release()
 		}
-	}
-	return nil
+		var ref string
+		if repo.CommitHash == "" {
+			ref, p.commit, p.err = resolveDefaultBranch(ctx, repo.URL)
+			if p.err == nil {
+				log.Infof("%s: using default branch %s at commit %s", repo.URL, ref, p.commit)
+			}
+		} else {
+			ref = repo.CommitHash
+			p.commit, p.err = resolveCommit(ctx, repo.URL, ref)
+			if p.err == nil {
+				log.Infof("%s: using %s at commit %s", repo.URL, ref, p.commit)
+			}
+		}
+		if ctx.Err() != nil {
+			p.err = errors.WithStack(ctx.Err())
+		} else if p.err != nil {
+			log.Warnf("%s: could not resolve %q to a commit, fetching it unpinned: %s", repo.URL, repo.Commit(), p.err)
+			p.commit, p.err = repo.Commit(), nil
+		}
+	})
+	return p.commit, p.err
 }
 
-type fetcherFunc func(u *url.URL, src, commit string) (NamedReadCloser, error)
+type fetcherFunc func(ctx context.Context, u *url.URL, src, commit string, creds *credentialStore) (NamedReadCloser, error)
 
-func fetchProto(config RemoteConfig, repo *Repo, proto string) (NamedReadCloser, error) {
+func fetchProto(ctx context.Context, config RemoteConfig, creds *credentialStore, limiter *hostLimiter, repo *Repo, proto string) (NamedReadCloser, error) {
+	relPath := repo.RepoPath(proto)
+	// Files at a specific commit are immutable, so can be served from the cache.
+	immutable := commitSHARe.MatchString(repo.Commit())
+	if immutable {
+		r, err := openCachedFile(repo.URL, repo.Commit(), relPath)
+		if err != nil || r != nil {
+			return r, err
+		}
+	}
+	if IsOffline(ctx) {
+		if !immutable {
+			return nil, errors.Errorf("%s: %q is not pinned to a commit, so %s can not be resolved offline", repo.URL, repo.Commit(), proto)
+		}
+		return nil, errors.Errorf("%s@%s: %s is not cached, and can not be fetched offline", repo.URL, repo.Commit(), relPath)
+	}
 	repoURL, err := repo.ParseURL()
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -88,21 +289,50 @@ func fetchProto(config RemoteConfig, repo *Repo, proto string) (NamedReadCloser,
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	// Hold a slot for the host until the caller has finished reading.
+	release, err := limiter.acquire(ctx, repoURL.Host)
+	if err != nil {
+		return nil, err
+	}
 	u := &url.URL{}
 	*u = *repoURL
-	relPath := path.Join(repo.Root, proto)
-	r, err := fetcher(u, relPath, repo.Commit())
+	r, err := fetcher(ctx, u, relPath, repo.Commit(), creds)
 	if errors.Is(err, errNotFound) { // try cloning repo
-		r, err = cloner(u, relPath, repo.Commit())
+		r, err = cloner(ctx, u, repo.sparsePaths(), relPath, repo.Commit())
 	}
 	if err != nil {
+		release()
 		return nil, errors.Wrap(err, repo.URL)
 	}
-
+	r = &namedReadCloser{name: r.Name(), ReadCloser: &releaseOnClose{ReadCloser: r, release: release}}
+	if immutable {
+		return cacheFile(r, repo.URL, repo.Commit(), relPath)
+	}
 	return r, nil
 }
 
+// Read a fetched file fully and write it to the content cache.
+func cacheFile(r NamedReadCloser, repoURL, commit, relPath string) (NamedReadCloser, error) {
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, r.Name())
+	}
+	if err := writeCachedFile(repoURL, commit, relPath, data); err != nil {
+		return nil, err
+	}
+	return &namedReadCloser{name: r.Name(), ReadCloser: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
 func chooseFetcher(config RemoteConfig, repo *Repo, repoURL *url.URL) (fetcherFunc, error) {
+	if repo.RawURL != "" {
+		return templateFetcher(repo.RawURL, repo.Headers), nil
+	}
+	for _, host := range config.Hosts {
+		if repoURL.Host == host.Host {
+			return templateFetcher(host.RawURL, host.Headers), nil
+		}
+	}
 	if repoURL.Host == "github.com" {
 		return githubFetcher, nil
 	}
@@ -111,10 +341,15 @@ func chooseFetcher(config RemoteConfig, repo *Repo, repoURL *url.URL) (fetcherFu
 			return bitBucketFetcher, nil
 		}
 	}
+	for _, gitlab := range config.GitLabServers {
+		if repoURL.Host == gitlab {
+			return gitLabFetcher, nil
+		}
+	}
 	return nil, errors.Errorf("unsupported repository source %q", repo.URL)
 }
 
-func bitBucketFetcher(repoURL *url.URL, relSrc, commit string) (NamedReadCloser, error) {
+func bitBucketFetcher(ctx context.Context, repoURL *url.URL, relSrc, commit string, creds *credentialStore) (NamedReadCloser, error) {
 	u := &url.URL{}
 	*u = *repoURL
 	// Override ssh+git
@@ -129,10 +364,40 @@ func bitBucketFetcher(repoURL *url.URL, relSrc, commit string) (NamedReadCloser,
 	repo := parts[3]
 	u.Path = path.Join("projects", project, "repos", repo, "raw", relSrc)
 	u.RawQuery = "at=" + commit
-	return httpGet(u.String())
+	header := http.Header{}
+	cred, err := creds.lookup(u.Host, "BITBUCKET_TOKEN")
+	if err != nil {
+		return nil, err
+	} else if cred != nil {
+		cred.basicOrBearer(header)
+	}
+	return httpGet(ctx, u.String(), header)
+}
+
+// gitLabFetcher retrieves files using the GitLab repository files API.
+func gitLabFetcher(ctx context.Context, repoURL *url.URL, relSrc, commit string, creds *credentialStore) (NamedReadCloser, error) {
+	scheme := "https"
+	if repoURL.Scheme == "http" {
+		scheme = "http"
+	}
+	// eg. /mygroup/mysubgroup/myservice.git
+	project := strings.Trim(strings.TrimSuffix(repoURL.Path, ".git"), "/")
+	if !strings.Contains(project, "/") {
+		return nil, errors.Errorf("expected GitLab URL path in the form /<group>[/<subgroup>...]/<repo>.git but got %q", repoURL.Path)
+	}
+	srcURL := fmt.Sprintf("%s://%s/api/v4/projects/%s/repository/files/%s/raw?ref=%s",
+		scheme, repoURL.Host, url.PathEscape(project), url.PathEscape(relSrc), url.QueryEscape(commit))
+	header := http.Header{}
+	cred, err := creds.lookup(repoURL.Host, "GITLAB_TOKEN")
+	if err != nil {
+		return nil, err
+	} else if cred != nil {
+		header.Set("PRIVATE-TOKEN", cred.secret)
+	}
+	return httpGet(ctx, srcURL, header)
 }
 
-func githubFetcher(ou *url.URL, relSrc, commit string) (NamedReadCloser, error) {
+func githubFetcher(ctx context.Context, ou *url.URL, relSrc, commit string, creds *credentialStore) (NamedReadCloser, error) {
 	u := &url.URL{}
 	*u = *ou
 	u.Scheme = "https"
@@ -147,13 +412,29 @@ func githubFetcher(ou *url.URL, relSrc, commit string) (NamedReadCloser, error)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return httpGet(u.String())
+	header := http.Header{}
+	cred, err := creds.lookup(ou.Host, "GITHUB_TOKEN")
+	if err != nil {
+		return nil, err
+	} else if cred != nil {
+		header.Set("Authorization", "Bearer "+cred.secret)
+	}
+	return httpGet(ctx, u.String(), header)
 }
 
 var errNotFound = errors.New("not found")
 
-func httpGet(srcURL string) (NamedReadCloser, error) {
-	resp, err := http.Get(srcURL)
+var httpClient = &http.Client{CheckRedirect: stripHeadersOnRedirect}
+
+func httpGet(ctx context.Context, srcURL string, header http.Header) (NamedReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srcURL, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -173,58 +454,194 @@ func httpGet(srcURL string) (NamedReadCloser, error) {
 // cloner is a fetcherFunc that git-clones repo to user-cache directory
 // and reads file. It is used when direct http download fails, for
 // instance because of permission issues.
-func cloner(u *url.URL, relPath, commit string) (NamedReadCloser, error) {
-	cacheDir, err := os.UserCacheDir()
+//
+// Only the requested commit is fetched, and only the "sparse" paths are checked out if provided. The
+// clone is shared between protosync processes, so is guarded by a file lock.
+func cloner(ctx context.Context, u *url.URL, sparse []string, relPath, commit string) (NamedReadCloser, error) {
+	cacheDir, err := CacheDir()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
-	repo := filepath.Base(u.Path) + "-" + hash(u.String(), commit)
-	dest := path.Join(cacheDir, "protosync", repo)
+	repo := filepath.Base(u.Path) + "-" + hash(u.String(), sparse)
+	dest := path.Join(cacheDir, repo)
+	unlock := lockCloneDir(dest)
+	defer unlock()
 	if err := os.MkdirAll(filepath.Dir(dest), 0o700); err != nil {
 		return nil, errors.Wrapf(err, "cannot create protosync cache directory %q", dest)
 	}
-	if err := gitClone(u.String(), dest); err != nil {
-		return nil, errors.WithStack(err)
+	unlockFile, err := lockFile(ctx, dest+".lock")
+	if err != nil {
+		return nil, err
 	}
-	if err := runInDir(dest, "git", "checkout", commit); err != nil {
+	defer unlockFile()
+	if err := gitCheckout(ctx, u.String(), dest, sparse, commit); err != nil {
 		return nil, errors.WithStack(err)
 	}
-	name := fmt.Sprintf("%s + %s", u.String(), relPath)
-	r, err := os.Open(path.Join(dest, relPath))
+	name := fmt.Sprintf("%s@%s + %s", u.String(), commit, relPath)
+	// Read the file while holding the lock, as another process may check out a different commit.
+	data, err := ioutil.ReadFile(path.Join(dest, relPath))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &namedReadCloser{name: name, ReadCloser: r}, nil
+	return &namedReadCloser{name: name, ReadCloser: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+var (
+	cloneDirsLock sync.Mutex
+	cloneDirs     = map[string]*sync.Mutex{}
+	// Clone directory to the HEAD checked out by this process, so each commit is only fetched once per run.
+	checkedOut = map[string]string{}
+)
+
+// Serialise access to a clone directory within this process.
+func lockCloneDir(dir string) (unlock func()) {
+	cloneDirsLock.Lock()
+	lock, ok := cloneDirs[dir]
+	if !ok {
+		lock = &sync.Mutex{}
+		cloneDirs[dir] = lock
+	}
+	cloneDirsLock.Unlock()
+	lock.Lock()
+	return lock.Unlock
 }
 
-func gitClone(sourceURL, destDir string) error {
-	// First, if a git repo exists, just pull.
-	info, _ := os.Stat(path.Join(destDir, ".git"))
-	if info != nil {
-		return runInDir(destDir, "git", "pull")
+// Check out a single commit of a repository into destDir, which must be locked.
+func gitCheckout(ctx context.Context, sourceURL, destDir string, sparse []string, commit string) error {
+	key := destDir + "@" + commit
+	cloneDirsLock.Lock()
+	head, ok := checkedOut[key]
+	cloneDirsLock.Unlock()
+	// Another process may have checked out a different commit since.
+	if ok && head == readHead(destDir) {
+		return nil
 	}
-	// No git repo, clone down to temporary directory.
+	if _, err := os.Stat(path.Join(destDir, ".git")); err != nil {
+		if err := gitInit(ctx, sourceURL, destDir, sparse); err != nil {
+			return err
+		}
+	}
+	// Skip the fetch if a previous run already fetched this commit.
+	if !commitSHARe.MatchString(commit) || !hasCommit(ctx, destDir, commit) {
+		if err := runInDir(ctx, destDir, "git", "fetch", "-q", "--depth=1", "origin", commit); err != nil {
+			return err
+		}
+		commit = "FETCH_HEAD"
+	}
+	if err := runInDir(ctx, destDir, "git", "-c", "advice.detachedHead=false", "checkout", "-q", "--detach", commit); err != nil {
+		return err
+	}
+	cloneDirsLock.Lock()
+	checkedOut[key] = readHead(destDir)
+	cloneDirsLock.Unlock()
+	return nil
+}
+
+// Initialise an empty repository in destDir, with a sparse checkout if paths are provided.
+func gitInit(ctx context.Context, sourceURL, destDir string, sparse []string) error {
+	// Initialise in a temporary directory so that a failure doesn't leave a broken repository behind.
 	tmpDestDir, err := os.MkdirTemp(filepath.Dir(destDir), filepath.Base(destDir)+"-*")
 	if err != nil {
 		return errors.Wrap(err, "cannot create temp directory for git clone")
 	}
 	defer os.RemoveAll(tmpDestDir)
-	if err = runInDir(tmpDestDir, "git", "clone", "--depth=1", sourceURL, tmpDestDir); err != nil {
-		return errors.WithStack(err)
+	if err = runInDir(ctx, tmpDestDir, "git", "init", "-q"); err != nil {
+		return err
+	}
+	if err = runInDir(ctx, tmpDestDir, "git", "remote", "add", "origin", sourceURL); err != nil {
+		return err
+	}
+	if len(sparse) > 0 {
+		if err = runInDir(ctx, tmpDestDir, "git", append([]string{"sparse-checkout", "set"}, sparse...)...); err != nil {
+			return err
+		}
+		// Only fetch the blobs that are checked out, if the server supports it.
+		if err = runInDir(ctx, tmpDestDir, "git", "config", "remote.origin.promisor", "true"); err != nil {
+			return err
+		}
+		if err = runInDir(ctx, tmpDestDir, "git", "config", "remote.origin.partialclonefilter", "blob:none"); err != nil {
+			return err
+		}
 	}
 	// And finally, rename it into place.
-	if err = os.Rename(tmpDestDir, destDir); err != nil {
-		return errors.WithStack(err)
+	return errors.WithStack(os.Rename(tmpDestDir, destDir))
+}
+
+// Returns true if the repository in dir contains commit.
+func hasCommit(ctx context.Context, dir, commit string) bool {
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "-e", commit+"^{commit}")
+	cmd.Dir = dir
+	return cmd.Run() == nil
+}
+
+// Read the commit checked out in a repository, returning "" if it can not be read.
+func readHead(dir string) string {
+	head, err := ioutil.ReadFile(filepath.Join(dir, ".git", "HEAD"))
+	if err != nil {
+		return ""
 	}
-	return nil
+	return strings.TrimSpace(string(head))
+}
+
+var commitSHARe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// resolveCommit resolves a branch or tag in a remote repository to its commit SHA.
+func resolveCommit(ctx context.Context, repoURL, ref string) (string, error) {
+	if commitSHARe.MatchString(ref) {
+		return ref, nil
+	}
+	log.Debugf("git ls-remote %s %s", repoURL, ref)
+	out, err := exec.CommandContext(ctx, "git", "ls-remote", repoURL, ref).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "git ls-remote %s %s", repoURL, ref)
+	}
+	// Annotated tags are listed twice, the peeled "^{}" entry being the commit itself.
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	for _, name := range []string{"refs/tags/" + ref + "^{}", "refs/tags/" + ref, "refs/heads/" + ref, ref} {
+		if sha, ok := refs[name]; ok {
+			return sha, nil
+		}
+	}
+	return "", errors.Errorf("%s: unknown ref %q", repoURL, ref)
+}
+
+// resolveDefaultBranch returns the default branch of a remote repository and its commit SHA.
+func resolveDefaultBranch(ctx context.Context, repoURL string) (branch, commit string, err error) {
+	log.Debugf("git ls-remote --symref %s HEAD", repoURL)
+	out, err := exec.CommandContext(ctx, "git", "ls-remote", "--symref", repoURL, "HEAD").Output()
+	if err != nil {
+		return "", "", errors.Wrapf(err, "git ls-remote --symref %s HEAD", repoURL)
+	}
+	// eg.
+	//   ref: refs/heads/main	HEAD
+	//   0123456789abcdef0123456789abcdef01234567	HEAD
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD":
+			branch = strings.TrimPrefix(fields[1], "refs/heads/")
+		case len(fields) == 2 && fields[1] == "HEAD":
+			commit = fields[0]
+		}
+	}
+	if branch == "" || commit == "" {
+		return "", "", errors.Errorf("%s: could not find the default branch in %q", repoURL, out)
+	}
+	return branch, commit, nil
 }
 
 // runInDir runs a command in the given directory.
-func runInDir(dir, cmdStr string, args ...string) error {
+func runInDir(ctx context.Context, dir, cmdStr string, args ...string) error {
 	log.Debugf("%s> %s %s", dir, cmdStr, strings.Join(args, " "))
 	buf := &bytes.Buffer{}
 	w := io.MultiWriter(buf, os.Stderr)
-	cmd := exec.Command(cmdStr, args...)
+	cmd := exec.CommandContext(ctx, cmdStr, args...)
 	cmd.Stderr = w
 	cmd.Dir = dir
 	if err := cmd.Run(); err != nil {
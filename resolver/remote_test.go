@@ -1,7 +1,17 @@
 package resolver // nolint: testpackage
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
@@ -16,7 +26,7 @@ func TestGithubFetcherShouldNotChangeURLScheme(t *testing.T) {
 	u, err := repoWithShortURL.ParseURL()
 	require.NoError(t, err)
 
-	reader, err := githubFetcher(u, "nonexistingcontent", "")
+	reader, err := githubFetcher(context.Background(), u, "nonexistingcontent", "", nil)
 	require.True(t, errors.Is(err, errNotFound))
 	require.Nil(t, reader)
 
@@ -39,7 +49,7 @@ func TestGithubFetcherShouldBeOkWithDifferentURLs(t *testing.T) {
 		u, err := repoWithShortURL.ParseURL()
 		require.NoError(t, err)
 
-		reader, err := githubFetcher(u, "nonexistingcontent", "")
+		reader, err := githubFetcher(context.Background(), u, "nonexistingcontent", "", nil)
 		require.True(t, errors.Is(err, errNotFound))
 		require.Nil(t, reader)
 	}
@@ -57,3 +67,276 @@ func TestRepoSSHShortURLParsing(t *testing.T) {
 	require.Equal(t, "cashapp/protosync.git", u.Path)
 	require.Equal(t, "git-1234", u.User.Username())
 }
+
+func TestHostLimiter(t *testing.T) {
+	t.Parallel()
+	limiter := newHostLimiter(2)
+	ctx := context.Background()
+	releaseA, err := limiter.acquire(ctx, "a")
+	require.NoError(t, err)
+	releaseB, err := limiter.acquire(ctx, "a")
+	require.NoError(t, err)
+	acquired := make(chan struct{})
+	go func() {
+		release, _ := limiter.acquire(ctx, "a")
+		release()
+		close(acquired)
+	}()
+	// Other hosts are not affected.
+	release, err := limiter.acquire(ctx, "b")
+	require.NoError(t, err)
+	release()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more than 2 slots for host")
+	case <-time.After(50 * time.Millisecond):
+	}
+	releaseA()
+	releaseA()
+	<-acquired
+	releaseB()
+}
+
+func TestGitLabFetcher(t *testing.T) {
+	t.Setenv("GITLAB_TOKEN", "secret")
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	creds := newCredentialStore(nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.EscapedPath() != "/api/v4/projects/group%2Fsubgroup%2Frepo/repository/files/proto%2Fa.proto/raw" ||
+			r.URL.Query().Get("ref") != "main" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`syntax = "proto3";`))
+	}))
+	defer srv.Close()
+	repo := &Repo{URL: srv.URL + "/group/subgroup/repo.git"}
+	u, err := repo.ParseURL()
+	require.NoError(t, err)
+
+	r, err := gitLabFetcher(context.Background(), u, "proto/a.proto", "main", creds)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, `syntax = "proto3";`, string(data))
+
+	_, err = gitLabFetcher(context.Background(), u, "proto/missing.proto", "main", creds)
+	require.True(t, errors.Is(err, errNotFound))
+}
+
+func TestTemplateFetcher(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/org/team/repo/raw/abc123/proto/a.proto" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`syntax = "proto3";`))
+	}))
+	defer srv.Close()
+	repo := &Repo{URL: srv.URL + "/org/team/repo.git"}
+	u, err := repo.ParseURL()
+	require.NoError(t, err)
+	config := RemoteConfig{Hosts: []HostConfig{{
+		Host:    u.Host,
+		RawURL:  "http://{host}/{owner}/{repo}/raw/{commit}/{path}",
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	}}}
+	fetcher, err := chooseFetcher(config, repo, u)
+	require.NoError(t, err)
+
+	r, err := fetcher(context.Background(), u, "proto/a.proto", "abc123", nil)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, `syntax = "proto3";`, string(data))
+
+	_, err = fetcher(context.Background(), u, "proto/missing.proto", "abc123", nil)
+	require.True(t, errors.Is(err, errNotFound))
+
+	// A repository's own template is sent its own headers.
+	repo.RawURL = "http://{host}/{owner}/{repo}/raw/{commit}/{path}"
+	repo.Headers = map[string]string{"Authorization": "Bearer secret"}
+	fetcher, err = chooseFetcher(RemoteConfig{}, repo, u)
+	require.NoError(t, err)
+	r, err = fetcher(context.Background(), u, "proto/a.proto", "abc123", nil)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	_, err = expandURLTemplate("https://{host}/{branch}/{path}", u, "a.proto", "abc123")
+	require.Error(t, err)
+}
+
+func TestTemplateFetcherCredentials(t *testing.T) {
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+	t.Setenv("RAW_TOKEN", "raw-secret")
+	t.Setenv("REPO_TOKEN", "repo-secret")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer raw-secret" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`syntax = "proto3";`))
+	}))
+	defer srv.Close()
+	u, err := url.Parse("https://git.example.com/org/repo.git")
+	require.NoError(t, err)
+	raw, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	creds := newCredentialStore([]CredentialConfig{
+		{Host: "git.example.com", TokenEnv: "REPO_TOKEN"},
+		{Host: raw.Hostname(), TokenEnv: "RAW_TOKEN"},
+	})
+
+	// Credentials are looked up for the raw file host, not the repository host.
+	r, err := templateFetcher(srv.URL+"/{project}/raw/{commit}/{path}", nil)(context.Background(), u, "a.proto", "abc123", creds)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+}
+
+func TestRemoteCache(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(`syntax = "proto3";`))
+	}))
+	defer srv.Close()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	repos := []Repo{{
+		URL:        srv.URL + "/org/repo.git",
+		Prefix:     "org/",
+		CommitHash: commit,
+		RawURL:     srv.URL + "/{project}/raw/{commit}/{path}",
+	}}
+	resolve := Remote(RemoteConfig{}, repos)
+	read := func(ctx context.Context) string {
+		r, err := resolve(ctx, "org/a.proto")
+		require.NoError(t, err)
+		defer r.Close()
+		require.Equal(t, Origin{Resolver: "remote", Source: repos[0].URL, Version: commit}, OriginOf(r))
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	require.Equal(t, `syntax = "proto3";`, read(context.Background()))
+	require.Equal(t, `syntax = "proto3";`, read(WithOffline(context.Background())))
+	require.Equal(t, 1, requests)
+
+	_, err := resolve(WithOffline(context.Background()), "org/b.proto")
+	require.EqualError(t, err, repos[0].URL+"@"+commit+": org/b.proto is not cached, and can not be fetched offline")
+
+	repos[0].CommitHash = "main"
+	_, err = Remote(RemoteConfig{}, repos)(WithOffline(context.Background()), "org/a.proto")
+	require.Error(t, err)
+}
+
+func TestResolveDefaultBranch(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	git := func(args ...string) {
+		err := runInDir(ctx, dir, "git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		require.NoError(t, err)
+	}
+	git("init", "-q", "-b", "trunk")
+	git("commit", "-q", "--allow-empty", "-m", "initial")
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	require.NoError(t, err)
+
+	branch, commit, err := resolveDefaultBranch(ctx, dir)
+	require.NoError(t, err)
+	require.Equal(t, "trunk", branch)
+
+	// Resolving the branch waits for a slot for the repository's host.
+	repo := &Repo{URL: dir}
+	u, err := repo.ParseURL()
+	require.NoError(t, err)
+	limiter := newHostLimiter(1)
+	release, err := limiter.acquire(ctx, u.Host)
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = (&pinnedCommit{}).resolve(timeoutCtx, limiter, repo)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	release()
+	pinned, err := (&pinnedCommit{}).resolve(ctx, limiter, repo)
+	require.NoError(t, err)
+	require.Equal(t, commit, pinned)
+	require.Equal(t, strings.TrimSpace(string(out)), commit)
+
+	// Files are fetched from the commit the default branch resolved to.
+	t.Setenv(CacheDirEnv, t.TempDir())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+commit+"/a.proto" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`syntax = "proto3";`))
+	}))
+	defer srv.Close()
+	resolve := Remote(RemoteConfig{}, []Repo{{URL: dir, Protos: []string{"a.proto"}, RawURL: srv.URL + "/{commit}/{path}"}})
+	r, err := resolve(ctx, "a.proto")
+	require.NoError(t, err)
+	defer r.Close()
+	require.Contains(t, r.Name(), commit)
+	require.Equal(t, commit, OriginOf(r).Version)
+}
+
+func TestCloner(t *testing.T) {
+	t.Setenv(CacheDirEnv, t.TempDir())
+	ctx := context.Background()
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	write := func(path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0o700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0o600))
+	}
+	git("init", "-q", "-b", "main")
+	write("protos/a.proto", "first")
+	write("other/b.proto", "other")
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	first := git("rev-parse", "HEAD")
+	write("protos/a.proto", "second")
+	git("commit", "-q", "-am", "second")
+	second := git("rev-parse", "HEAD")
+
+	u, err := url.Parse("file://" + dir)
+	require.NoError(t, err)
+	read := func(commit string) string {
+		r, err := cloner(ctx, u, []string{"protos"}, "protos/a.proto", commit)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+	// Commits other than the tip can be retrieved.
+	require.Equal(t, "first", read(first))
+	require.Equal(t, "second", read(second))
+	require.Equal(t, "first", read(first))
+
+	// Only the root is checked out.
+	cacheDir, err := CacheDir()
+	require.NoError(t, err)
+	clone := filepath.Join(cacheDir, filepath.Base(dir)+"-"+hash(u.String(), []string{"protos"}))
+	_, err = os.Stat(filepath.Join(clone, "other", "b.proto"))
+	require.True(t, os.IsNotExist(err))
+}
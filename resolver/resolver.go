@@ -2,7 +2,10 @@
 package resolver
 
 import (
+	"context"
 	"io"
+
+	"github.com/pkg/errors"
 )
 
 // NamedReadCloser gives an io.ReadCloser an identity.
@@ -11,16 +14,55 @@ type NamedReadCloser interface {
 	io.ReadCloser
 }
 
+// Origin describes exactly where a resolved proto was retrieved from.
+type Origin struct {
+	// Resolver is the kind of resolver that served the proto, eg. "remote".
+	Resolver string `json:"resolver"`
+	// Source is the repository URL, Artifactory repository path or local path.
+	Source string `json:"source"`
+	// Version is the commit SHA or JAR version, if any.
+	Version string `json:"version,omitempty"`
+}
+
+// OriginOf returns the Origin of a NamedReadCloser returned by a Resolver.
+//
+// If the NamedReadCloser does not carry an Origin, one is synthesised from its name.
+func OriginOf(r NamedReadCloser) Origin {
+	if o, ok := r.(interface{ Origin() Origin }); ok {
+		return o.Origin()
+	}
+	return Origin{Resolver: "unknown", Source: r.Name()}
+}
+
 // A Resolver can resolve proto imports to source.
 //
-// Will return (nil, nil) if not found.
-type Resolver func(path string) (NamedReadCloser, error)
+// Will return (nil, nil) if not found. Resolvers must be safe for concurrent use, and
+// should abort as soon as possible if ctx is cancelled.
+type Resolver func(ctx context.Context, path string) (NamedReadCloser, error)
+
+// ContextFreeResolver is a Resolver that does not support cancellation.
+type ContextFreeResolver func(path string) (NamedReadCloser, error)
+
+// Adapt a ContextFreeResolver to a Resolver.
+//
+// The context is checked before each call, but the call itself can not be cancelled.
+func Adapt(resolve ContextFreeResolver) Resolver {
+	return func(ctx context.Context, path string) (NamedReadCloser, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return resolve(path)
+	}
+}
 
 // Combine a set of resolvers, trying each in turn.
 func Combine(resolvers ...Resolver) Resolver {
-	return func(path string) (NamedReadCloser, error) {
+	return func(ctx context.Context, path string) (NamedReadCloser, error) {
 		for _, resolve := range resolvers {
-			r, err := resolve(path)
+			if err := ctx.Err(); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			r, err := resolve(ctx, path)
 			if err != nil {
 				return nil, err
 			}
@@ -33,8 +75,10 @@ func Combine(resolvers ...Resolver) Resolver {
 }
 
 type namedReadCloser struct {
-	name string
+	name   string
+	origin Origin
 	io.ReadCloser
 }
 
-func (n *namedReadCloser) Name() string { return n.name }
+func (n *namedReadCloser) Name() string   { return n.name }
+func (n *namedReadCloser) Origin() Origin { return n.origin }
@@ -0,0 +1,75 @@
+package resolver
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HostConfig defines how to retrieve raw files from a git host via a URL template.
+type HostConfig struct {
+	Host    string            `hcl:"host,label" help:"Hostname of the git server, eg. git.example.com"`
+	RawURL  string            `hcl:"raw-url" help:"URL template for raw files, eg. \"https://git.example.com/{owner}/{repo}/raw/{commit}/{path}\". Variables are {host}, {project} (the full repository path), {owner}, {repo}, {commit} and {path}."`
+	Headers map[string]string `hcl:"headers,optional" help:"HTTP headers to send with each request."`
+}
+
+var templateVarRe = regexp.MustCompile(`{[a-z]+}`)
+
+// templateFetcher returns a fetcherFunc that expands a raw file URL template.
+func templateFetcher(rawURL string, headers map[string]string) fetcherFunc {
+	return func(ctx context.Context, repoURL *url.URL, relSrc, commit string, creds *credentialStore) (NamedReadCloser, error) {
+		srcURL, err := expandURLTemplate(rawURL, repoURL, relSrc, commit)
+		if err != nil {
+			return nil, err
+		}
+		// Credentials are for the host the file is fetched from, which may differ from the repository's.
+		u, err := url.Parse(srcURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid raw file URL %q", srcURL)
+		}
+		header := http.Header{}
+		cred, err := creds.lookup(u.Host, "")
+		if err != nil {
+			return nil, err
+		} else if cred != nil {
+			cred.basicOrBearer(header)
+		}
+		// Explicitly configured headers take precedence over credentials.
+		for key, value := range headers {
+			header.Set(key, value)
+		}
+		return httpGet(ctx, srcURL, header)
+	}
+}
+
+func expandURLTemplate(template string, repoURL *url.URL, relSrc, commit string) (string, error) {
+	project := strings.Trim(strings.TrimSuffix(repoURL.Path, ".git"), "/")
+	owner, repo := "", project
+	if i := strings.LastIndex(project, "/"); i != -1 {
+		owner, repo = project[:i], project[i+1:]
+	}
+	vars := map[string]string{
+		"{host}":    repoURL.Host,
+		"{project}": project,
+		"{owner}":   owner,
+		"{repo}":    repo,
+		"{commit}":  commit,
+		"{path}":    relSrc,
+	}
+	var unknown string
+	out := templateVarRe.ReplaceAllStringFunc(template, func(v string) string {
+		value, ok := vars[v]
+		if !ok {
+			unknown = v
+		}
+		return value
+	})
+	if unknown != "" {
+		return "", errors.Errorf("unknown variable %s in URL template %q", unknown, template)
+	}
+	return out, nil
+}
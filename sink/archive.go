@@ -0,0 +1,76 @@
+package sink
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveSink buffers files in memory and writes them as an archive when closed.
+//
+// Files are written in sorted order with a zero modification time, so the archive is
+// reproducible for identical content.
+type ArchiveSink struct {
+	*MemorySink
+	w     io.Writer
+	write func(w io.Writer, names []string, files map[string][]byte) error
+}
+
+// Zip returns a Sink that writes a zip archive to w when closed.
+func Zip(w io.Writer) *ArchiveSink {
+	return &ArchiveSink{MemorySink: Memory(), w: w, write: writeZip}
+}
+
+// Tar returns a Sink that writes a tar archive to w when closed.
+func Tar(w io.Writer) *ArchiveSink {
+	return &ArchiveSink{MemorySink: Memory(), w: w, write: writeTar}
+}
+
+// Close writes the archive.
+func (a *ArchiveSink) Close() error {
+	files := a.Files()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return a.write(a.w, names, files)
+}
+
+func writeZip(w io.Writer, names []string, files map[string][]byte) error {
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		if _, err := fw.Write(files[name]); err != nil {
+			return errors.Wrap(err, name)
+		}
+	}
+	return errors.WithStack(zw.Close())
+}
+
+func writeTar(w io.Writer, names []string, files map[string][]byte) error {
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(files[name])),
+			ModTime:  time.Unix(0, 0),
+		})
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return errors.Wrap(err, name)
+		}
+	}
+	return errors.WithStack(tw.Close())
+}
@@ -0,0 +1,214 @@
+// Package sink contains the destinations that synced .proto files can be written to.
+package sink
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Sink is a destination for synced files.
+//
+// Names are slash-separated paths relative to the root of the sink, as used by io/fs. The
+// synced tree can be read back through the embedded fs.FS.
+type Sink interface {
+	fs.FS
+	// WriteFile creates or replaces a file, creating parent directories as necessary.
+	WriteFile(name string, data []byte) error
+	// Remove a file, along with any parent directories left empty.
+	//
+	// Removing a file that does not exist is not an error.
+	Remove(name string) error
+	// Location of a file in the sink, for display.
+	Location(name string) string
+}
+
+// A Persistent Sink retains its content between syncs, such as a directory.
+//
+// protosync only records which files it owns, in order to prune them later, in persistent sinks,
+// so that archives and in-memory sinks contain nothing but synced files.
+type Persistent interface {
+	Sink
+	// Persistent is a marker method.
+	Persistent()
+}
+
+// Dir returns a Sink that writes to a directory on the local filesystem.
+func Dir(dir string) Sink {
+	return &dirSink{FS: os.DirFS(dir), dir: dir}
+}
+
+type dirSink struct {
+	fs.FS
+	dir string
+}
+
+func (d *dirSink) Persistent() {}
+
+func (d *dirSink) WriteFile(name string, data []byte) error {
+	dest := d.Location(name)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(dest, data, 0o666)) // nolint: gosec
+}
+
+func (d *dirSink) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	dest := d.Location(name)
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	for dir := filepath.Dir(dest); dir != filepath.Clean(d.dir); dir = filepath.Dir(dir) {
+		// Fails if the directory is not empty, which is what we want.
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *dirSink) Location(name string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(name))
+}
+
+// MemorySink is a Sink that stores files in memory.
+type MemorySink struct {
+	files memFS
+}
+
+var _ Sink = &MemorySink{}
+
+// Memory returns an empty in-memory Sink.
+func Memory() *MemorySink {
+	return &MemorySink{files: memFS{}}
+}
+
+// Open a file or directory.
+func (m *MemorySink) Open(name string) (fs.File, error) { return m.files.Open(name) }
+
+// WriteFile stores a copy of data.
+func (m *MemorySink) WriteFile(name string, data []byte) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	m.files[name] = append([]byte{}, data...)
+	return nil
+}
+
+// Remove a file.
+func (m *MemorySink) Remove(name string) error {
+	delete(m.files, name)
+	return nil
+}
+
+// Location of a file in memory.
+func (m *MemorySink) Location(name string) string { return "memory:" + name }
+
+// Files returns the content of each file in the sink, keyed by name.
+func (m *MemorySink) Files() map[string][]byte {
+	out := make(map[string][]byte, len(m.files))
+	for name, data := range m.files {
+		out[name] = data
+	}
+	return out
+}
+
+// memFS is a read-only fs.FS over file content keyed by name. Directories are implied by the
+// names of the files they contain.
+type memFS map[string][]byte
+
+func (m memFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if data, ok := m[name]; ok {
+		return &memFile{Reader: bytes.NewReader(data), info: memInfo{name: path.Base(name), size: int64(len(data))}}, nil
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	entries := []fs.DirEntry{}
+	seen := map[string]bool{}
+	for file, data := range m {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		child := memInfo{name: strings.TrimPrefix(file, prefix), size: int64(len(data))}
+		if i := strings.Index(child.name, "/"); i >= 0 {
+			child = memInfo{name: child.name[:i], dir: true}
+		}
+		if !seen[child.name] {
+			seen[child.name] = true
+			entries = append(entries, fs.FileInfoToDirEntry(child))
+		}
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return &memDir{info: memInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+}
+
+type memInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() interface{}   { return nil }
+func (i memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+type memFile struct {
+	*bytes.Reader
+	info memInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memDir struct {
+	info    memInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(entries) {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+	return entries, nil
+}
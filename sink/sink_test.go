@@ -0,0 +1,63 @@
+package sink // nolint: testpackage
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirRemovesEmptyParents(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	dest := Dir(dir)
+	require.NoError(t, dest.WriteFile("a/b/c.proto", []byte("c")))
+	require.NoError(t, dest.WriteFile("a/d.proto", []byte("d")))
+	data, err := fs.ReadFile(dest, "a/b/c.proto")
+	require.NoError(t, err)
+	require.Equal(t, "c", string(data))
+
+	require.NoError(t, dest.Remove("a/b/c.proto"))
+	require.NoDirExists(t, filepath.Join(dir, "a/b"))
+	require.FileExists(t, filepath.Join(dir, "a/d.proto"))
+	require.NoError(t, dest.Remove("a/b/c.proto"))
+	require.Error(t, dest.Remove("../a/d.proto"))
+}
+
+func TestMemory(t *testing.T) {
+	t.Parallel()
+	dest := Memory()
+	require.NoError(t, dest.WriteFile("a/b/c.proto", []byte("c")))
+	require.NoError(t, dest.WriteFile("a/d.proto", []byte("d")))
+	require.NoError(t, dest.WriteFile("e.proto", []byte("e")))
+	require.NoError(t, fstest.TestFS(dest, "a/b/c.proto", "a/d.proto", "e.proto"))
+
+	require.NoError(t, dest.Remove("a/b/c.proto"))
+	_, err := fs.Stat(dest, "a/b")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Equal(t, map[string][]byte{"a/d.proto": []byte("d"), "e.proto": []byte("e")}, dest.Files())
+}
+
+func TestZip(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	dest := Zip(buf)
+	require.NoError(t, dest.WriteFile("b.proto", []byte("b")))
+	require.NoError(t, dest.WriteFile("a/a.proto", []byte("a")))
+	require.NoError(t, dest.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 2)
+	require.Equal(t, "a/a.proto", zr.File[0].Name)
+	r, err := zr.File[0].Open()
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(data))
+}